@@ -0,0 +1,21 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+var chownWarning sync.Once
+
+// chownOutput does nothing, files here have no Unix owner for --output-uid and --output-gid to
+// set, so it just warns once.
+func chownOutput() error {
+	if *outputUIDFlag >= 0 || *outputGIDFlag >= 0 {
+		chownWarning.Do(func() {
+			errLogger.Printf("Warning: --output-uid and --output-gid are ignored on %s", runtime.GOOS)
+		})
+	}
+	return nil
+}
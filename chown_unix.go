@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// chownOutput chowns the output dir and everything in it to --output-uid and --output-gid, e.g.
+// so a build as root in a container leaves files the host user can remove.
+func chownOutput() error {
+	if *outputUIDFlag < 0 && *outputGIDFlag < 0 {
+		return nil
+	}
+	return filepath.Walk(*outFlag, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Lchown, symlinks copied into the output are chowned themselves, not their targets
+		return os.Lchown(path, *outputUIDFlag, *outputGIDFlag)
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sortBy returns the elements of list sorted by the value at key (see lookupKey), without
+// changing list. Elements without the key go last, and ties are broken by their "path" key so the
+// order is deterministic, e.g. {{range sortBy "weight" (json "posts.json")}}.
+func sortBy(key string, list interface{}) ([]interface{}, error) {
+	return sortList(list, key)
+}
+
+// sortList is sortBy with the list first and an optional order, asc (the default) or desc, e.g.
+// {{range sort .Pages "Page.date" "desc"}}. Elements without the key go last either way.
+func sortList(list interface{}, key string, order ...string) ([]interface{}, error) {
+	desc := false
+	if len(order) > 1 {
+		return nil, fmt.Errorf("sort takes one order, not %d", len(order))
+	} else if len(order) == 1 {
+		switch order[0] {
+		case "asc":
+		case "desc":
+			desc = true
+		default:
+			return nil, fmt.Errorf("sort order must be asc or desc, not %s", order[0])
+		}
+	}
+	items, err := toSlice(list)
+	if err != nil {
+		return nil, err
+	}
+	var sortErr error
+	sort.SliceStable(items, func(i, j int) bool {
+		a, aOK := lookupKey(items[i], key)
+		b, bOK := lookupKey(items[j], key)
+		if aOK != bOK {
+			return aOK
+		}
+		if aOK {
+			c, err := compareValues(a, b)
+			if err != nil && sortErr == nil {
+				sortErr = fmt.Errorf("sort by %s: %v", key, err)
+			}
+			if c != 0 {
+				return (c < 0) != desc
+			}
+		}
+		aPath, _ := lookupKey(items[i], "path")
+		bPath, _ := lookupKey(items[j], "path")
+		return fmt.Sprint(aPath) < fmt.Sprint(bPath)
+	})
+	return items, sortErr
+}
+
+// where returns the elements of list whose value at key (see lookupKey) equals value, e.g.
+// {{range where .Pages "Page.category" "news"}}. Elements without the key are left out. Numbers
+// are equal whatever their type, so front matter's 3 matches a template's 3.
+func where(list interface{}, key string, value interface{}) ([]interface{}, error) {
+	items, err := toSlice(list)
+	if err != nil {
+		return nil, err
+	}
+	matches := []interface{}{}
+	for _, item := range items {
+		if v, ok := lookupKey(item, key); ok && valuesEqual(v, value) {
+			matches = append(matches, item)
+		}
+	}
+	return matches, nil
+}
+
+// valuesEqual reports whether a and b are the same number, string, or time, or else deeply equal.
+func valuesEqual(a, b interface{}) bool {
+	if c, err := compareValues(a, b); err == nil {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// first returns the first n elements of list, or all of them if it has fewer, e.g.
+// {{range first 5 .Pages}}.
+func first(n int, list interface{}) ([]interface{}, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("first needs 0 or more elements, not %d", n)
+	}
+	items, err := toSlice(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > n {
+		items = items[:n]
+	}
+	return items, nil
+}
+
+// toSlice copies the elements of the slice or array list.
+func toSlice(list interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%T is not a list", list)
+	}
+	items := make([]interface{}, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// stringList returns v as a list of strings, for front matter values that may be a string or a
+// list, nil if it's neither.
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, item := range v {
+			list[i] = fmt.Sprint(item)
+		}
+		return list
+	}
+	return nil
+}
+
+// lookuper is for values with their own idea of which keys they have, see lookupKey.
+type lookuper interface {
+	Lookup(key string) (interface{}, bool)
+}
+
+// lookupKey returns the value at the dot separated key path in v, where each part is a map key
+// or a struct field (matched case insensitively, so "path" finds a Path field), or whatever
+// Lookup returns for a lookuper.
+func lookupKey(v interface{}, key string) (interface{}, bool) {
+	for _, part := range strings.Split(key, ".") {
+		if l, ok := v.(lookuper); ok {
+			if v, ok = l.Lookup(part); !ok {
+				return nil, false
+			}
+			continue
+		}
+		rv := reflect.ValueOf(v)
+		for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+			if rv.IsNil() {
+				return nil, false
+			}
+			rv = rv.Elem()
+		}
+		switch rv.Kind() {
+		case reflect.Map:
+			if rv.Type().Key().Kind() != reflect.String {
+				return nil, false
+			}
+			elem := rv.MapIndex(reflect.ValueOf(part).Convert(rv.Type().Key()))
+			if !elem.IsValid() {
+				return nil, false
+			}
+			v = elem.Interface()
+		case reflect.Struct:
+			field := rv.FieldByNameFunc(func(name string) bool {
+				return strings.EqualFold(name, part)
+			})
+			if !field.IsValid() || !field.CanInterface() {
+				return nil, false
+			}
+			v = field.Interface()
+		default:
+			return nil, false
+		}
+	}
+	return v, v != nil
+}
+
+// compareValues orders two numbers, strings, or times, returning -1, 0, or 1.
+func compareValues(a, b interface{}) (int, error) {
+	if at, ok := a.(time.Time); ok {
+		if bt, ok := b.(time.Time); ok {
+			switch {
+			case at.Before(bt):
+				return -1, nil
+			case at.After(bt):
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if af, ok := toFloat(a); ok {
+		if bf, ok := toFloat(b); ok {
+			switch {
+			case af < bf:
+				return -1, nil
+			case af > bf:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return strings.Compare(as, bs), nil
+		}
+	}
+	return 0, fmt.Errorf("can't compare %T with %T", a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// color is an sRGB color with channels in [0, 1].
+type color struct {
+	r, g, b float64
+}
+
+// parseColor parses a #rgb or #rrggbb hex color, the # is optional.
+func parseColor(v string) (color, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(v), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color{}, fmt.Errorf("%q is not a #rgb or #rrggbb color", v)
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color{}, fmt.Errorf("%q is not a #rgb or #rrggbb color", v)
+	}
+	return color{
+		r: float64(n>>16&0xff) / 255,
+		g: float64(n>>8&0xff) / 255,
+		b: float64(n&0xff) / 255,
+	}, nil
+}
+
+func (c color) channels() (uint8, uint8, uint8) {
+	return uint8(math.Round(c.r * 255)), uint8(math.Round(c.g * 255)), uint8(math.Round(c.b * 255))
+}
+
+func (c color) hex() template.CSS {
+	r, g, b := c.channels()
+	return template.CSS(fmt.Sprintf("#%02x%02x%02x", r, g, b))
+}
+
+func (c color) rgba(alpha float64) template.CSS {
+	r, g, b := c.channels()
+	return template.CSS(fmt.Sprintf("rgba(%d, %d, %d, %s)", r, g, b, strconv.FormatFloat(clamp(alpha), 'f', -1, 64)))
+}
+
+// lighten moves the HSL lightness by amount, like Sass's lighten with amount as a fraction
+// instead of a percentage. A negative amount darkens.
+func (c color) lighten(amount float64) color {
+	h, s, l := c.hsl()
+	return hslColor(h, s, clamp(l+amount))
+}
+
+func (c color) hsl() (h, s, l float64) {
+	max := math.Max(c.r, math.Max(c.g, c.b))
+	min := math.Min(c.r, math.Min(c.g, c.b))
+	l = (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+	d := max - min
+	if l > 0.5 {
+		s = d / (2 - max - min)
+	} else {
+		s = d / (max + min)
+	}
+	switch max {
+	case c.r:
+		h = (c.g - c.b) / d
+		if c.g < c.b {
+			h += 6
+		}
+	case c.g:
+		h = (c.b-c.r)/d + 2
+	default:
+		h = (c.r-c.g)/d + 4
+	}
+	return h / 6, s, l
+}
+
+func hslColor(h, s, l float64) color {
+	if s == 0 {
+		return color{l, l, l}
+	}
+	q := l * (1 + s)
+	if l >= 0.5 {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	return color{
+		r: hueChannel(p, q, h+1.0/3),
+		g: hueChannel(p, q, h),
+		b: hueChannel(p, q, h-1.0/3),
+	}
+}
+
+func hueChannel(p, q, t float64) float64 {
+	if t < 0 {
+		t++
+	} else if t > 1 {
+		t--
+	}
+	switch {
+	case t < 1.0/6:
+		return p + (q-p)*6*t
+	case t < 1.0/2:
+		return q
+	case t < 2.0/3:
+		return p + (q-p)*(2.0/3-t)*6
+	default:
+		return p
+	}
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadConfig sets each flag not given on the command line from the --config file at path, an
+// object of flag names to values like --print-config prints. A list sets a repeatable flag once
+// per item, and is space separated for the others.
+func loadConfig(path string) error {
+	v, err := readDataFile(path)
+	if err != nil {
+		return err
+	}
+	config, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: must be an object of flag names to values", path)
+	}
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	names := []string{}
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" || name == "print-config" {
+			return fmt.Errorf("%s: unknown key %s, it must be the name of a flag", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		values := []interface{}{config[name]}
+		if list, ok := config[name].([]interface{}); ok {
+			if _, repeatable := f.Value.(*stringsFlag); repeatable {
+				values = list
+			}
+		}
+		for _, value := range values {
+			if err := f.Value.Set(configValue(f, value)); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValue returns v from a --config file as a flag value string. Numbers for durations are
+// nanoseconds, as --print-config prints them.
+func configValue(f *flag.Flag, v interface{}) string {
+	_, isDuration := f.Value.(flag.Getter).Get().(time.Duration)
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		if isDuration {
+			return time.Duration(v).String()
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		if isDuration {
+			return time.Duration(v).String()
+		}
+		return strconv.Itoa(v)
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, configValue(f, item))
+		}
+		return strings.Join(items, " ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
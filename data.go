@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dataFiles remembers each file the data funcs (json, yaml, read, markdown) read during a build,
+// parsed the way each func parses it, so pages using the same file share one read and parse.
+var dataFiles = struct {
+	mu    sync.Mutex
+	files map[string]*dataResult
+}{files: map[string]*dataResult{}}
+
+type dataResult struct {
+	once sync.Once
+	v    interface{}
+	err  error
+}
+
+// resetDataFiles forgets the data files read by the last build.
+func resetDataFiles() {
+	dataFiles.mu.Lock()
+	dataFiles.files = map[string]*dataResult{}
+	dataFiles.mu.Unlock()
+}
+
+// dataFuncs returns the funcs reading files from the --data dir for a page in the input-relative
+// dir: json and yaml parse a file, read returns it as a string, and markdown renders it. Each looks
+// for the file in the page's dir within the --data dir, then in each dir above it, e.g. for
+// posts.json from blog/2024/post.html, data/blog/2024/posts.json, data/blog/posts.json, then
+// data/posts.json.
+func dataFuncs(dir string) template.FuncMap {
+	return template.FuncMap{
+		"json": func(file string) (interface{}, error) {
+			return readData("json", dir, file, func(path string, data []byte) (interface{}, error) {
+				var obj interface{}
+				if err := json.Unmarshal(data, &obj); err != nil {
+					return nil, fmt.Errorf("%s: %v", path, err)
+				}
+				return obj, nil
+			})
+		},
+		"yaml": func(file string) (interface{}, error) {
+			return readData("yaml", dir, file, func(path string, data []byte) (interface{}, error) {
+				var obj interface{}
+				if err := yaml.Unmarshal(data, &obj); err != nil {
+					return nil, fmt.Errorf("%s: %v", path, err)
+				}
+				return obj, nil
+			})
+		},
+		"read": func(file string) (string, error) {
+			v, err := readData("read", dir, file, func(path string, data []byte) (interface{}, error) {
+				return string(data), nil
+			})
+			s, _ := v.(string)
+			return s, err
+		},
+		"markdown": func(file string) (template.HTML, error) {
+			v, err := readData("markdown", dir, file, func(path string, data []byte) (interface{}, error) {
+				out, err := markdown(path, data)
+				return template.HTML(out), err
+			})
+			html, _ := v.(template.HTML)
+			return html, err
+		},
+	}
+}
+
+func init() {
+	// Until withPageFuncs binds them to a page's dir
+	for name, f := range dataFuncs(".") {
+		TemplateFuncs[name] = f
+	}
+}
+
+// resolveData returns the path of file in the --data dir for a page in the input-relative dir, see
+// dataFuncs.
+func resolveData(dir, file string) (string, error) {
+	tried := []string{}
+	for {
+		path := filepath.Join(*dataFlag, dir, file)
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return path, nil
+		}
+		tried = append(tried, filepath.Join(*dataFlag, dir))
+		if dir == "." || dir == string(filepath.Separator) {
+			return "", &DataError{filepath.Join(*dataFlag, file), fmt.Errorf("no %s in %s (looked in the page's dir within the data dir and each dir above it, in that order)", file, strings.Join(tried, ", "))}
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// readData returns the file under the --data dir, found from the page's dir (see resolveData),
+// parsed by parse, which is called once per build for each file and func, named by kind. The result
+// is shared, so callers mustn't modify it.
+func readData(kind, dir, file string, parse func(path string, data []byte) (interface{}, error)) (interface{}, error) {
+	path, err := resolveData(dir, file)
+	if err != nil {
+		return nil, err
+	}
+	key := path
+	if abs, err := filepath.Abs(path); err == nil {
+		key = abs
+	}
+	key = kind + " " + key
+	dataFiles.mu.Lock()
+	result, ok := dataFiles.files[key]
+	if !ok {
+		result = &dataResult{}
+		dataFiles.files[key] = result
+	}
+	dataFiles.mu.Unlock()
+	result.once.Do(func() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			result.err = &DataError{path, err}
+			return
+		}
+		result.v, result.err = parse(path, data)
+		if result.err != nil {
+			result.err = &DataError{path, result.err}
+		}
+	})
+	return result.v, result.err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// printDiff writes to w which files in mem (a build of --out) are added, removed, or modified
+// relative to what's on disk in --out, with line diffs of modified text files for --diff-content.
+// It reports whether anything differs.
+func printDiff(w io.Writer, mem *MemFS) (bool, error) {
+	old := map[string]bool{}
+	if err := filepath.Walk(*outFlag, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == *outFlag {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			old[path] = true
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	changed := false
+	for _, path := range mem.Files() {
+		newData, err := mem.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		if !old[path] {
+			fmt.Fprintf(w, "A %s\n", path)
+			changed = true
+			continue
+		}
+		delete(old, path)
+		oldData, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(oldData, newData) {
+			continue
+		}
+		fmt.Fprintf(w, "M %s\n", path)
+		changed = true
+		if *diffContentFlag {
+			writeLineDiff(w, oldData, newData)
+		}
+	}
+	removed := []string{}
+	for path := range old {
+		removed = append(removed, path)
+	}
+	sort.Strings(removed)
+	for _, path := range removed {
+		fmt.Fprintf(w, "D %s\n", path)
+		changed = true
+	}
+	return changed, nil
+}
+
+// maxDiffCells caps the size of the table writeLineDiff builds, lines in a times lines in b.
+const maxDiffCells = 4 << 20
+
+// writeLineDiff writes the lines removed from a and added in b, indented under the file name.
+func writeLineDiff(w io.Writer, a, b []byte) {
+	if !isText(a) || !isText(b) {
+		fmt.Fprintln(w, "    (binary)")
+		return
+	}
+	aLines := strings.SplitAfter(string(a), "\n")
+	bLines := strings.SplitAfter(string(b), "\n")
+	if len(aLines)*len(bLines) > maxDiffCells {
+		fmt.Fprintln(w, "    (too large to diff)")
+		return
+	}
+	// Longest common subsequence, lcs[i][j] is for aLines[i:] and bLines[j:]
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	line := func(prefix, text string) {
+		fmt.Fprintf(w, "    %s %s\n", prefix, strings.TrimSuffix(text, "\n"))
+	}
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			i++
+			j++
+		case j == len(bLines) || (i < len(aLines) && lcs[i+1][j] >= lcs[i][j+1]):
+			line("-", aLines[i])
+			i++
+		default:
+			line("+", bLines[j])
+			j++
+		}
+	}
+}
+
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
@@ -0,0 +1,42 @@
+package main
+
+// The errors build passes to its errLogFunc are one of these types where the kind of failure is
+// known, so callers can tell them apart with errors.As. Their messages are the cause's, which
+// already name the file.
+
+// ParseError is a template or its front matter failing to parse.
+type ParseError struct {
+	Path string
+	Err  error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() }
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ExecuteError is a template failing to execute.
+type ExecuteError struct {
+	Path string
+	Err  error
+}
+
+func (e *ExecuteError) Error() string { return e.Err.Error() }
+func (e *ExecuteError) Unwrap() error { return e.Err }
+
+// DataError is a data file (see --data and --redirects) that is missing or malformed. Data files
+// read by templates fail their execution, so these are usually wrapped in an ExecuteError.
+type DataError struct {
+	Path string
+	Err  error
+}
+
+func (e *DataError) Error() string { return e.Err.Error() }
+func (e *DataError) Unwrap() error { return e.Err }
+
+// IOError is reading an input or writing an output failing.
+type IOError struct {
+	Path string
+	Err  error
+}
+
+func (e *IOError) Error() string { return e.Err.Error() }
+func (e *IOError) Unwrap() error { return e.Err }
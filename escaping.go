@@ -0,0 +1,141 @@
+package main
+
+import (
+	"html/template"
+	"sort"
+	"text/template/parse"
+)
+
+// untrustedFields are the TemplateData fields drawn from front matter, which whoever writes the
+// content controls rather than whoever writes the templates.
+var untrustedFields = []string{"Page", "Pages", "Term", "Terms"}
+
+// untrustedFuncs return data from elsewhere.
+var untrustedFuncs = []string{"fetch", "getJSON"}
+
+// auditHTML warns, for --strict-html-escaping, wherever a template in t passes front matter or
+// fetched data to html, which marks it as safe so html/template won't escape it. Templates whose
+// tree is unchanged from the one in skip were audited already. Only pipelines are followed, not
+// values stored in variables first.
+func auditHTML(t *template.Template, skip map[string]*parse.Tree) {
+	templates := t.Templates()
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name() < templates[j].Name()
+	})
+	for _, tt := range templates {
+		if tt.Tree == nil || tt.Tree.Root == nil || skip[tt.Name()] == tt.Tree {
+			continue
+		}
+		tree := tt.Tree
+		walkPipes(tree.Root, func(pipe *parse.PipeNode) {
+			for i, cmd := range pipe.Cmds {
+				if !isIdent(cmd.Args[0], "html") {
+					continue
+				}
+				// Piped in from the commands before, or given as arguments
+				inputs := []parse.Node{}
+				for _, prev := range pipe.Cmds[:i] {
+					inputs = append(inputs, prev)
+				}
+				inputs = append(inputs, cmd.Args[1:]...)
+				for _, input := range inputs {
+					if untrusted(input) {
+						location, context := tree.ErrorContext(pipe)
+						errLogger.Printf("Warning: %s: {{%s}} passes front matter or fetched data to html, which won't be escaped", location, context)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// walkPipes calls f with each pipeline in the template parse tree under node, nested ones included.
+func walkPipes(node parse.Node, f func(*parse.PipeNode)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkPipes(child, f)
+		}
+	case *parse.ActionNode:
+		walkPipes(n.Pipe, f)
+	case *parse.IfNode:
+		walkPipes(n.Pipe, f)
+		walkPipes(n.List, f)
+		walkPipes(n.ElseList, f)
+	case *parse.RangeNode:
+		walkPipes(n.Pipe, f)
+		walkPipes(n.List, f)
+		walkPipes(n.ElseList, f)
+	case *parse.WithNode:
+		walkPipes(n.Pipe, f)
+		walkPipes(n.List, f)
+		walkPipes(n.ElseList, f)
+	case *parse.TemplateNode:
+		walkPipes(n.Pipe, f)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		f(n)
+		for _, cmd := range n.Cmds {
+			walkPipes(cmd, f)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkPipes(arg, f)
+		}
+	case *parse.ChainNode:
+		walkPipes(n.Node, f)
+	}
+}
+
+// untrusted reports whether the template parse tree under node refers to one of the
+// untrustedFields or calls one of the untrustedFuncs.
+func untrusted(node parse.Node) bool {
+	for _, name := range untrustedFields {
+		if usesField(node, name) {
+			return true
+		}
+	}
+	return callsFunc(node, untrustedFuncs)
+}
+
+// callsFunc reports whether the template parse tree under node calls any of the funcs.
+func callsFunc(node parse.Node, funcs []string) bool {
+	switch n := node.(type) {
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if callsFunc(cmd, funcs) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if callsFunc(arg, funcs) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return callsFunc(n.Node, funcs)
+	case *parse.IdentifierNode:
+		for _, name := range funcs {
+			if n.Ident == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isIdent reports whether node is the func name.
+func isIdent(node parse.Node, name string) bool {
+	ident, ok := node.(*parse.IdentifierNode)
+	return ok && ident.Ident == name
+}
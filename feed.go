@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// feedContents collects the rendered content of the --feed-dir pages, by language and then path.
+type feedContents struct {
+	mu       sync.Mutex
+	contents map[string]map[string]template.HTML
+}
+
+var feedContent = &feedContents{}
+
+func (c *feedContents) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.contents = map[string]map[string]template.HTML{}
+}
+
+// add keeps content, as rendered for .Content, if page is one of the --feed-dir pages.
+func (c *feedContents) add(page *PageInfo, content template.HTML) {
+	if !inFeed(page) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.contents[page.Lang] == nil {
+		c.contents[page.Lang] = map[string]template.HTML{}
+	}
+	c.contents[page.Lang][page.Path] = content
+}
+
+// inFeed reports whether page goes in the --feed-dir feed, a dated page under the dir that isn't a
+// draft.
+func inFeed(page *PageInfo) bool {
+	dir := strings.Trim(filepath.ToSlash(*feedDirFlag), "/")
+	return !page.Date.IsZero() && page.Page["draft"] != true && (dir == "." || strings.HasPrefix(page.Path, dir+"/"))
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title     string    `xml:"title"`
+	ID        string    `xml:"id"`
+	Link      atomLink  `xml:"link"`
+	Published string    `xml:"published"`
+	Updated   string    `xml:"updated"`
+	Author    *atomName `xml:"author,omitempty"`
+	Summary   string    `xml:"summary,omitempty"`
+	Content   *atomHTML `xml:"content,omitempty"`
+}
+
+type atomName struct {
+	Name string `xml:"name"`
+}
+
+type atomHTML struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// write writes the Atom feed.xml of the pages in lang that are inFeed, newest first and at most
+// --feed-limit of them, in the output dir for lang. Each entry has the page's content if it has
+// any, and the summary (or else description) from its front matter.
+func (c *feedContents) write(lang string, pages []*PageInfo) error {
+	outPath := filepath.Join(*outFlag, lang, "feed.xml")
+	if outputWritten(outPath) {
+		verboseLogger.Printf("Not writing feed, the input dir has one: %s", outPath)
+		return nil
+	}
+	entries := []*PageInfo{}
+	for _, page := range pages {
+		if inFeed(page) {
+			entries = append(entries, page)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Date.Equal(entries[j].Date) {
+			return entries[i].Date.After(entries[j].Date)
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	if *feedLimitFlag > 0 && len(entries) > *feedLimitFlag {
+		entries = entries[:*feedLimitFlag]
+	}
+
+	home := baseURL + langURL(lang, "/")
+	feed := atomFeed{
+		Xmlns: "http://www.w3.org/2005/Atom",
+		Title: *feedTitleFlag,
+		ID:    home,
+		Links: []atomLink{{Href: home}, {Rel: "self", Href: baseURL + langURL(lang, "/feed.xml")}},
+	}
+	if feed.Title == "" {
+		feed.Title = baseURL
+	}
+	// Reproducible, unlike the build time
+	updated := time.Unix(0, 0).UTC()
+	if len(entries) > 0 {
+		updated = entries[0].Date
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, page := range entries {
+		link := baseURL + langURL(lang, page.URL)
+		entry := atomEntry{
+			Title:     page.Title,
+			ID:        link,
+			Link:      atomLink{Href: link},
+			Published: page.Date.Format(time.RFC3339),
+			Updated:   page.Date.Format(time.RFC3339),
+		}
+		if entry.Title == "" {
+			entry.Title = page.Path
+		}
+		if author, ok := page.Page["author"]; ok {
+			entry.Author = &atomName{fmt.Sprint(author)}
+		}
+		if summary, ok := page.Page["summary"]; ok {
+			entry.Summary = fmt.Sprint(summary)
+		} else if description, ok := page.Page["description"]; ok {
+			entry.Summary = fmt.Sprint(description)
+		}
+		if content := strings.TrimSpace(string(c.contents[lang][page.Path])); content != "" {
+			entry.Content = &atomHTML{"html", content}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	b, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	verboseLogger.Printf("Writing feed: %s", outPath)
+	return writeOutputFile(outPath, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fetches remembers each URL fetched during a build, so pages fetching the same URL share one
+// request.
+var fetches = struct {
+	mu   sync.Mutex
+	urls map[string]*fetchResult
+}{urls: map[string]*fetchResult{}}
+
+type fetchResult struct {
+	once sync.Once
+	body []byte
+	err  error
+}
+
+// resetFetches forgets the URLs fetched by the last build.
+func resetFetches() {
+	fetches.mu.Lock()
+	fetches.urls = map[string]*fetchResult{}
+	fetches.mu.Unlock()
+}
+
+// fetch returns the body of a GET of url, from the --fetch-cache if it's newer than
+// --fetch-max-age (or whatever its age with --offline).
+func fetch(url string) ([]byte, error) {
+	fetches.mu.Lock()
+	result, ok := fetches.urls[url]
+	if !ok {
+		result = &fetchResult{}
+		fetches.urls[url] = result
+	}
+	fetches.mu.Unlock()
+	result.once.Do(func() {
+		result.body, result.err = fetchCached(url)
+		if result.err != nil {
+			result.err = &DataError{url, result.err}
+		}
+	})
+	return result.body, result.err
+}
+
+func fetchCached(url string) ([]byte, error) {
+	cachePath := ""
+	if *fetchCacheFlag != "" {
+		cachePath = filepath.Join(*fetchCacheFlag, fmt.Sprintf("%x", sha256.Sum256([]byte(url))))
+		if info, err := os.Stat(cachePath); err == nil && (*offlineFlag || time.Since(info.ModTime()) < *fetchMaxAgeFlag) {
+			verboseLogger.Printf("Using cached fetch: %s", url)
+			return ioutil.ReadFile(cachePath)
+		}
+	}
+	if *offlineFlag {
+		return nil, fmt.Errorf("%s isn't in the --fetch-cache and --offline is set", url)
+	}
+	verboseLogger.Printf("Fetching: %s", url)
+	client := &http.Client{Timeout: *fetchTimeoutFlag}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %v", url, err)
+	}
+	if cachePath != "" {
+		if err := os.MkdirAll(*fetchCacheFlag, 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(cachePath, body, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readGlobalsDir reads a --globals dir, putting the data of each .json, .yaml, or .yml file in it
+// under a key named after the file (e.g. menus.yaml is .Globals.menus), then merging the files in
+// its --globals-env subdir over them the same way. Files are merged in name order, so a key in a
+// later file wins.
+func readGlobalsDir(dir string) (interface{}, error) {
+	globals, err := mergeGlobalsDir(map[string]interface{}{}, dir)
+	if err != nil {
+		return nil, err
+	}
+	if *globalsEnvFlag != "" {
+		envDir := filepath.Join(dir, *globalsEnvFlag)
+		if _, err := os.Stat(envDir); os.IsNotExist(err) {
+			verboseLogger.Printf("No --globals-env dir: %s", envDir)
+			return globals, nil
+		}
+		if globals, err = mergeGlobalsDir(globals, envDir); err != nil {
+			return nil, err
+		}
+	}
+	return globals, nil
+}
+
+// mergeGlobalsDir merges the data files directly in dir over globals, see readGlobalsDir.
+func mergeGlobalsDir(globals interface{}, dir string) (interface{}, error) {
+	// ReadDir sorts by name
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, &DataError{dir, err}
+	}
+	for _, info := range infos {
+		ext := filepath.Ext(info.Name())
+		if info.IsDir() || (ext != ".json" && ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		v, err := readDataFile(path)
+		if err != nil {
+			return nil, err
+		}
+		verboseLogger.Printf("Merging globals: %s", path)
+		globals = mergeData(globals, map[string]interface{}{strings.TrimSuffix(info.Name(), ext): v})
+	}
+	return globals, nil
+}
+
+// mergeData returns over merged into base. Maps are merged key by key at every depth, anything
+// else in over replaces what's in base. Neither is changed.
+func mergeData(base, over interface{}) interface{} {
+	baseMap, ok := base.(map[string]interface{})
+	if !ok {
+		return over
+	}
+	overMap, ok := over.(map[string]interface{})
+	if !ok {
+		return over
+	}
+	merged := make(map[string]interface{}, len(baseMap))
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+	for k, v := range overMap {
+		merged[k] = mergeData(merged[k], v)
+	}
+	return merged
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// useHighlightStyle makes markdown highlight fenced code blocks that name their language, as
+// spans with chroma's css classes for the style to color. Blocks without a language, or in one
+// chroma doesn't know, are left as plain <pre><code>.
+func useHighlightStyle(style string) error {
+	if _, ok := styles.Registry[style]; !ok {
+		return fmt.Errorf("--highlight-style %s isn't one of %s", style, strings.Join(styles.Names(), " "))
+	}
+	markdownParser = goldmark.New(
+		goldmark.WithExtensions(extension.GFM, highlighting.NewHighlighting(
+			highlighting.WithStyle(style),
+			highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+			highlighting.WithGuessLanguage(false),
+		)),
+		goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()),
+	)
+	return nil
+}
+
+// writeHighlightCSS writes the css of the --highlight-style at the output-relative outRelPath.
+func writeHighlightCSS(outRelPath string) error {
+	outPath := filepath.Join(*outFlag, outRelPath)
+	if outputWritten(outPath) {
+		verboseLogger.Printf("Not writing highlight css, the input dir has one: %s", outPath)
+		return nil
+	}
+	css := bytes.Buffer{}
+	if err := chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(&css, styles.Get(*highlightStyleFlag)); err != nil {
+		return err
+	}
+	if err := Output.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+	verboseLogger.Printf("Writing highlight css: %s", outPath)
+	return writeOutputFile(outPath, css.Bytes(), 0644)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// catalogs holds the --i18n message catalog of each of the --languages for this build, by language
+// then dotted key.
+var catalogs = map[string]map[string]interface{}{}
+
+// missingTranslations remembers the language and key of each fallback warned about this build, so
+// a string missing from every page only warns once.
+var missingTranslations = struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}{keys: map[string]bool{}}
+
+// readCatalogs reads the catalog of each of langs from the --i18n dir, lang.json, lang.yaml, or
+// lang.yml, nested keys flattened to dotted ones (e.g. nav.home). A language without one gets an
+// empty catalog, falling back to the default language for everything.
+func readCatalogs(langs []string) (map[string]map[string]interface{}, error) {
+	all := map[string]map[string]interface{}{}
+	for _, lang := range langs {
+		catalog := map[string]interface{}{}
+		for _, ext := range []string{".json", ".yaml", ".yml"} {
+			path := filepath.Join(*i18nFlag, lang+ext)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				continue
+			}
+			v, err := readDataFile(path)
+			if err != nil {
+				return nil, err
+			}
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, &DataError{path, fmt.Errorf("%s: catalog is %T, not a map", path, v)}
+			}
+			flattenCatalog(catalog, "", m)
+		}
+		all[lang] = catalog
+	}
+	missingTranslations.mu.Lock()
+	missingTranslations.keys = map[string]bool{}
+	missingTranslations.mu.Unlock()
+	return all, nil
+}
+
+// flattenCatalog adds the values in m to catalog under their dotted keys, each prefixed with
+// prefix.
+func flattenCatalog(catalog map[string]interface{}, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenCatalog(catalog, prefix+k+".", nested)
+		} else {
+			catalog[prefix+k] = v
+		}
+	}
+}
+
+// translate returns the message at key in the catalog of lang, formatted with args like Sprintf
+// if any are given. A key missing from lang falls back to the default (first) language, with a
+// warning.
+func translate(lang, key string, args ...interface{}) (string, error) {
+	langs := languages()
+	if lang == "" {
+		return "", fmt.Errorf("T %s: no --languages to translate into", key)
+	}
+	msg, ok := catalogs[lang][key]
+	if !ok && lang != langs[0] {
+		missingTranslations.mu.Lock()
+		if !missingTranslations.keys[lang+" "+key] {
+			missingTranslations.keys[lang+" "+key] = true
+			errLogger.Printf("Warning: no %s translation of %s in %s, using %s", lang, key, *i18nFlag, langs[0])
+		}
+		missingTranslations.mu.Unlock()
+		msg, ok = catalogs[langs[0]][key]
+	}
+	if !ok {
+		return "", fmt.Errorf("T %s: not in the %s catalog in %s", key, langs[0], *i18nFlag)
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(fmt.Sprint(msg), args...), nil
+	}
+	return fmt.Sprint(msg), nil
+}
+
+// languages returns the --languages, or just "" without any, for pages built once without a
+// language prefix.
+func languages() []string {
+	langs := strings.Fields(*languagesFlag)
+	if len(langs) == 0 {
+		return []string{""}
+	}
+	return langs
+}
+
+// langURL returns the absolute url path of a page as built for lang.
+func langURL(lang, url string) string {
+	if lang == "" {
+		return url
+	}
+	return "/" + lang + url
+}
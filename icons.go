@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// icons remembers each icon read during a build, since the same ones show up on most pages.
+var icons = struct {
+	mu    sync.Mutex
+	icons map[string]*iconResult
+}{icons: map[string]*iconResult{}}
+
+type iconResult struct {
+	once sync.Once
+	icon *svgIcon
+	err  error
+}
+
+// svgIcon is an svg file split around the start tag of its root element.
+type svgIcon struct {
+	attrs       []xml.Attr
+	selfClosing bool
+	rest        string // After the start tag
+}
+
+// resetIcons forgets the icons read by the last build.
+func resetIcons() {
+	icons.mu.Lock()
+	icons.icons = map[string]*iconResult{}
+	icons.mu.Unlock()
+}
+
+// icon returns the svg file name (.svg optional) in the --icons dir to inline in a page, with the
+// attrs, name value pairs, set on its root element, e.g. {{icon "github" "class" "icon" "width" "16"}}.
+func icon(name string, attrs ...string) (template.HTML, error) {
+	if len(attrs)%2 != 0 {
+		return "", fmt.Errorf("icon %s: attrs must be name value pairs", name)
+	}
+	if filepath.Ext(name) != ".svg" {
+		name += ".svg"
+	}
+	path := filepath.Join(*iconsFlag, filepath.FromSlash(name))
+	if !withinDir(*iconsFlag, path) {
+		return "", fmt.Errorf("icon %s is outside %s", name, *iconsFlag)
+	}
+	icons.mu.Lock()
+	result, ok := icons.icons[path]
+	if !ok {
+		result = &iconResult{}
+		icons.icons[path] = result
+	}
+	icons.mu.Unlock()
+	result.once.Do(func() {
+		result.icon, result.err = readIcon(path)
+	})
+	if result.err != nil {
+		return "", result.err
+	}
+	return result.icon.render(attrs), nil
+}
+
+// readIcon reads the svg file at path, failing if it isn't an svg or has scripts in it, which
+// would run once inlined.
+func readIcon(path string) (*svgIcon, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &DataError{path, err}
+	}
+	var icon *svgIcon
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		start := d.InputOffset()
+		// Raw, to keep the prefixes of names as written
+		token, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &DataError{path, fmt.Errorf("%s: %v", path, err)}
+		}
+		el, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if err := checkIconElement(el); err != nil {
+			return nil, &DataError{path, fmt.Errorf("%s: %v", path, err)}
+		}
+		if icon == nil {
+			if el.Name.Local != "svg" {
+				return nil, &DataError{path, fmt.Errorf("%s: root element is %s, not svg", path, el.Name.Local)}
+			}
+			end := d.InputOffset()
+			icon = &svgIcon{
+				attrs:       el.Attr,
+				selfClosing: bytes.HasSuffix(data[start:end], []byte("/>")),
+				rest:        strings.TrimSpace(string(data[end:])),
+			}
+		}
+	}
+	if icon == nil {
+		return nil, &DataError{path, fmt.Errorf("%s: not an svg", path)}
+	}
+	return icon, nil
+}
+
+// checkIconElement returns an error if el would run script.
+func checkIconElement(el xml.StartElement) error {
+	if el.Name.Local == "script" {
+		return errors.New("svg has a script element")
+	}
+	for _, attr := range el.Attr {
+		if strings.HasPrefix(strings.ToLower(attr.Name.Local), "on") {
+			return fmt.Errorf("svg has an event handler attribute %s", attr.Name.Local)
+		}
+		if attr.Name.Local == "href" && strings.HasPrefix(strings.ToLower(strings.TrimSpace(attr.Value)), "javascript:") {
+			return errors.New("svg has a javascript: link")
+		}
+	}
+	return nil
+}
+
+// render returns the icon with the attrs, name value pairs, set on its root element.
+func (icon *svgIcon) render(attrs []string) template.HTML {
+	set := map[string]string{}
+	for i := 0; i < len(attrs); i += 2 {
+		set[attrs[i]] = attrs[i+1]
+	}
+	b := strings.Builder{}
+	b.WriteString("<svg")
+	for _, attr := range icon.attrs {
+		name := attr.Name.Local
+		if attr.Name.Space != "" {
+			name = attr.Name.Space + ":" + name
+		}
+		value, ok := set[name]
+		if ok {
+			delete(set, name)
+		} else {
+			value = attr.Value
+		}
+		fmt.Fprintf(&b, ` %s="%s"`, name, html.EscapeString(value))
+	}
+	// In the order given
+	for i := 0; i < len(attrs); i += 2 {
+		if value, ok := set[attrs[i]]; ok {
+			fmt.Fprintf(&b, ` %s="%s"`, html.EscapeString(attrs[i]), html.EscapeString(value))
+			delete(set, attrs[i])
+		}
+	}
+	if icon.selfClosing {
+		b.WriteString("/>")
+	} else {
+		b.WriteString(">" + icon.rest)
+	}
+	return template.HTML(b.String())
+}
@@ -1,21 +1,41 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"text/template/parse"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 var usagePrefix = fmt.Sprintf(`Builds a static site using the html/template package, with TemplateData provided.
@@ -26,305 +46,2797 @@ OPTIONS:
 `, os.Args[0])
 
 var (
-	inFlag        = flag.String("in", "src", "Input dir")
-	outFlag       = flag.String("out", "docs", "Output dir")
-	dataFlag      = flag.String("data", "data", "Data dir (for json data)")
-	templatesFlag = flag.String("templates", "templates/base.html templates", "String separated list of template files/dirs. The first one is the base template (required)")
-	verboseFlag   = flag.Bool("verbose", false, "Verbose output")
-	addrFlag      = flag.String("addr", "", "Address to serve output dir, if provided")
-	maxOpenFlag   = flag.Int("max-open", 100, "Max number of files to open at once")
+	inFlag                   = flag.String("in", "src", "Input dir")
+	outFlag                  = flag.String("out", "docs", "Output dir, or - to write a tar archive of the output to stdout")
+	dataFlag                 = flag.String("data", "data", "Data dir (for json and yaml data), where the data funcs look in the page's dir first, e.g. data/blog/ for src/blog/post.html, and then each dir above it")
+	templatesFlag            = flag.String("templates", "templates/base.html templates", "String separated list of template files/dirs. The first one is the base template (required)")
+	verboseFlag              = flag.Bool("verbose", false, "Verbose output")
+	addrFlag                 = flag.String("addr", "", "Address to serve output dir, if provided")
+	maxOpenFlag              = flag.Int("max-open", 100, "Max number of files to open at once")
+	bannerFlag               = flag.Bool("banner", false, "Prepend a generated-file comment to rendered and text output")
+	bannerTextFlag           = flag.String("banner-text", "Generated by {tool} from {source} at {time}; do not edit", "Text of the --banner comment, {tool}, {source}, and {time} are replaced")
+	bannerExtFlag            = flag.String("banner-ext", ".html", "String separated list of file extensions that get the --banner, from .html .htm .svg .css .js")
+	maxFileSizeFlag          = flag.Int64("max-file-size", 0, "Max size in bytes of an input file, 0 for no limit")
+	maxFileSizeModeFlag      = flag.String("max-file-size-mode", "skip", "What to do with files over --max-file-size, skip (with a warning) or fail")
+	redirectsFlag            = flag.String("redirects", "", "JSON file mapping old paths to new paths, redirect pages are written at the old paths")
+	rewriteFlag              = flag.Bool("rewrite-redirects", false, "Rewrite URLs to old paths in --redirects to their new paths")
+	dumpContextFlag          = flag.String("dump-context", "", "Log the template data for this page (path relative to the input dir)")
+	strictURLsFlag           = flag.Bool("strict-urls", false, "Error on URLs that resolve outside the input dir, or on page-style URLs (trailing slash) to plain files")
+	profileTemplatesFlag     = flag.Bool("profile-templates", false, "Print time spent executing each template, summed over all pages")
+	watchPathsFlag           = flag.String("watch-paths", "", "String separated list of extra files/dirs to watch, for --watch-command only")
+	watchCommandFlag         = stringsFlag{}
+	debounceFlag             = flag.Duration("debounce", 300*time.Millisecond, "How long watched paths have to be quiet after a change before rebuilding, so saving several files at once is one rebuild")
+	pollIntervalFlag         = flag.Duration("poll-interval", 0, "Watch by scanning the watched paths this often instead of with filesystem events, for filesystems that don't deliver them (e.g. some network and container mounts), 0 for events")
+	printConfigFlag          = flag.Bool("print-config", false, "Print the effective configuration as JSON and exit without building")
+	configFlag               = flag.String("config", "", "JSON (or .yaml/.yml) file of flag values by name (e.g. {\"in\": \"site\", \"minify\": true}, as --print-config prints them) for the flags not given on the command line")
+	readTimeoutFlag          = flag.Duration("read-timeout", 10*time.Second, "Preview server timeout for reading a request, 0 for none")
+	writeTimeoutFlag         = flag.Duration("write-timeout", 30*time.Second, "Preview server timeout for writing a response, 0 for none")
+	templateExtFlag          = flag.String("template-ext", ".html", "Space or comma separated list of file extensions (e.g. .html .htm .xml) of pages, executed as templates, the rest being copied as is. Only .html and .htm pages go in a layout")
+	ignoreFlag               = flag.String("ignore", "", "String separated list of glob patterns (e.g. .DS_Store *.swp drafts/*) of files and dirs in the input and --static dirs to leave out, matched against the path relative to the dir, or the base name for patterns without a /")
+	rawExtFlag               = flag.String("raw-ext", "", "String separated list of file extensions (e.g. .raw.html) to always copy as is, never execute as templates")
+	searchIndexFlag          = flag.String("search-index", "", "Output path (relative to the output dir) to write a json search index of the pages to, if provided")
+	accessLogFlag            = flag.Bool("access-log", false, "Log each request to the server at --addr")
+	diffFlag                 = flag.Bool("diff", false, "Build in memory, print the files that would be added (A), modified (M), or deleted (D) in the output dir, and ask before writing them")
+	dryRunFlag               = flag.Bool("dry-run", false, "Like --diff, but only print the changes, never writing them. Fails if the build does, so it can check a site in CI without touching the output dir")
+	diffContentFlag          = flag.Bool("diff-content", false, "With --diff, also print the changed lines of modified text files")
+	baseTemplateOptionalFlag = flag.Bool("base-template-optional", false, "Render pages standalone (like layout: none) if they override nothing in their layout and it doesn't use .Content, instead of warning")
+	preprocessFlag           = stringsFlag{}
+	setFlag                  = stringsFlag{}
+	prettyURLsFlag           = flag.Bool("pretty-urls", false, "Build pages at name/index.html instead of name.html (e.g. about.html at about/index.html), linked to from .URL and .Pages as about/. Pages already named index.html, and the root 404.html, stay where they are")
+	indexDirURLsFlag         = flag.Bool("index-dir-urls", false, "Link to index.html pages by their dir (e.g. blog/ instead of blog/index.html) from .URL and .Pages")
+	stripHTMLExtFlag         = flag.Bool("strip-html-ext", false, "Drop .html from the links .URL returns (e.g. about instead of about.html), output files keep it")
+	retryFlag                = flag.Int("retry", 0, "Times to retry reading an input file after an error other than it missing or permission denied, e.g. for network filesystems")
+	retryDelayFlag           = flag.Duration("retry-delay", 100*time.Millisecond, "Delay before the first --retry, doubling for each one after")
+	cspFlag                  = flag.String("csp", "", "Content-Security-Policy header for html responses from the server at --addr, if provided")
+	cspReportOnlyFlag        = flag.Bool("csp-report-only", false, "Send --csp as Content-Security-Policy-Report-Only instead")
+	taxonomiesFlag           = flag.String("taxonomies", "", "String separated list of front matter keys (e.g. tags categories) to generate a page at /key/term/ for each of the terms of, and one at /key/ listing them")
+	taxonomyTemplateFlag     = flag.String("taxonomy-template", "taxonomy", "Template in --templates for each --taxonomies term page, with the term as .Term")
+	termsTemplateFlag        = flag.String("terms-template", "terms", "Template in --templates for each --taxonomies page listing its .Terms")
+	strictCaseFlag           = flag.Bool("strict-case", false, "Error on URLs whose case differs from the file names they resolve to, which case insensitive filesystems allow but case sensitive hosts don't")
+	compactJSONFlag          = flag.Bool("compact-json", false, "Write generated json files (e.g. --search-index) without indentation")
+	liveReloadFlag           = flag.Bool("live-reload", true, "Reload the pages open in browsers from the server at --addr after each successful rebuild, with a script injected into html responses (the output files are unchanged)")
+	serveInjectFlag          = flag.String("serve-inject", "", "File of html to insert before </body> in html responses from the server at --addr, the output files are unchanged")
+	templateErrorModeFlag    = flag.String("template-error-mode", "fail", "What a failing partial does, fail the page, or placeholder to show the error in its place (with a warning)")
+	stateFlag                = flag.String("state", "", "File to keep input hashes in between builds, to only rebuild the files that changed (everything if templates, data, front matter, or flags did)")
+	fetchTimeoutFlag         = flag.Duration("fetch-timeout", 10*time.Second, "Timeout for each request by the fetch and getJSON funcs")
+	fetchCacheFlag           = flag.String("fetch-cache", ".fetch-cache", "Dir to cache fetch and getJSON responses in, keyed by URL, none if empty")
+	fetchMaxAgeFlag          = flag.Duration("fetch-max-age", time.Hour, "How long a --fetch-cache response is used before fetching the URL again")
+	offlineFlag              = flag.Bool("offline", false, "Use --fetch-cache responses whatever their age instead of fetching, failing for URLs that aren't cached")
+	globalsFlag              = flag.String("globals", "", "JSON (or .yaml/.yml) file whose data every template gets as .Globals, if provided. If a dir, each file in it is a key of .Globals named after it (e.g. menus.yaml is .Globals.menus)")
+	globalsEnvFlag           = flag.String("globals-env", "", "Subdir of a --globals dir (e.g. production) whose files are merged over the ones above it, maps key by key")
+	staticFlag               = flag.String("static", "", "Dir of files to copy to the output dir as is, never executed or preprocessed, if provided")
+	mermaidFlag              = flag.Bool("mermaid", false, "Replace mermaid diagrams in pages (mermaid code blocks or <pre class=\"mermaid\">) with inline svg from --mermaid-command, leaving any that fail as they are")
+	mermaidCommandFlag       = flag.String("mermaid-command", "mmdc --quiet -i {{input}} -o {{output}}", "Command run with sh to render a --mermaid diagram, {{input}} is replaced with the diagram source file and {{output}} with the svg file to write")
+	languagesFlag            = flag.String("languages", "", "String separated list of languages (e.g. en fr) to build each page in, under /en/, /fr/, and so on, the first being the default. Pages get their language as .Lang and the T func to translate with")
+	i18nFlag                 = flag.String("i18n", "i18n", "Dir of the message catalogs for the T func, lang.json (or .yaml/.yml) for each of the --languages")
+	iconsFlag                = flag.String("icons", "icons", "Dir of svg files for the icon func to inline")
+	sourceMapsFlag           = flag.Bool("source-maps", false, "Also write a source map (.css.map) next to the css built from each .scss file, for debugging against the scss")
+	strictHTMLEscapingFlag   = flag.Bool("strict-html-escaping", false, "Warn wherever templates pass front matter (.Page, .Pages, .Term, .Terms) or fetch or getJSON data to html, which marks it safe so it isn't escaped")
+	markdownExtFlag          = flag.String("markdown-ext", ".md .markdown", "String separated list of file extensions to render as markdown pages, e.g. post.md builds post.html")
+	maxErrorsFlag            = flag.Int("max-errors", 0, "Stop a build after this many errors, 0 for no limit")
+	outputUIDFlag            = flag.Int("output-uid", -1, "User id to chown the files and dirs in the output dir to after each build (Unix only), -1 to leave it as is")
+	buildTimeFlag            = flag.String("build-time", "", "Time (RFC3339 or unix seconds) to build as, for the now func and --banner, instead of when each build starts, defaulting to the SOURCE_DATE_EPOCH environment variable if set. Also makes uniq reproducible")
+	outputGIDFlag            = flag.Int("output-gid", -1, "Group id to chown the files and dirs in the output dir to after each build (Unix only), -1 to leave it as is")
+	feedDirFlag              = flag.String("feed-dir", "", "Dir of pages (relative to the input dir, e.g. blog, or . for all) to write an Atom feed.xml of, from those with a front matter date, if provided. Needs --base-url")
+	feedLimitFlag            = flag.Int("feed-limit", 20, "Max number of the newest --feed-dir pages in the feed, 0 for no limit")
+	feedTitleFlag            = flag.String("feed-title", "", "Title of the --feed-dir feed, --base-url if empty")
+	cleanFlag                = flag.Bool("clean", true, "Empty the output dir before each full build. If false, files in it are only written over (or left as they are if their content is the same), and the ones the last such build wrote that this one didn't are removed, leaving others (e.g. CNAME) alone. Those written are listed in "+outputsFile+" in the output dir")
+	draftsFlag               = flag.Bool("drafts", false, "Build pages whose front matter has draft: true, which are skipped otherwise (they're never in taxonomies, --search-index, sitemap.xml, or feeds)")
+	fingerprintExtFlag       = flag.String("fingerprint-ext", "", "String separated list of file extensions (e.g. .css .js) of copied files to add a hash of their content to the names of (e.g. style.1a2b3c4d.css), for the asset func to link to")
+	minifyFlag               = flag.Bool("minify", false, "Collapse whitespace and remove comments in rendered pages, leaving the content of <pre>, <textarea>, <script>, and <style> as is")
+	baseURLFlag              = flag.String("base-url", "", "URL the site is served at (e.g. https://example.com), to write a sitemap.xml of its pages with, if provided")
+	tlsCertFlag              = flag.String("tls-cert", "", "Certificate file (PEM) to serve --addr over HTTPS with, along with --tls-key")
+	tlsKeyFlag               = flag.String("tls-key", "", "Private key file (PEM) of --tls-cert")
+	highlightStyleFlag       = flag.String("highlight-style", "", "Chroma style (e.g. github or monokai) to highlight fenced code blocks in markdown with, by language, if provided. The blocks get css classes, see --highlight-css")
+	highlightCSSFlag         = flag.String("highlight-css", "", "Output path (relative to the output dir, e.g. highlight.css) to write the css of the --highlight-style to, if provided")
+	seedFlag                 = flag.String("seed", "", "Seed for the uniq func to derive its ids from, so they're the same each build, if provided. Otherwise they're random unless --build-time is pinned")
+	manifestFlag             = flag.String("manifest", "manifest.json", "Output path (relative to the output dir) to write a json list of the files in the output dir, with their sizes and sha256 hashes, to after each successful build, none if empty or with --out -")
 )
 
+func init() {
+	flag.Var(&preprocessFlag, "preprocess", ".ext=command or .ext:.outext=command to build files with that extension from the stdout of the command run with sh, {{input}} is replaced with the file path. May be repeated, --markdown-ext and .scss (sass command, leaving out _partial.scss files) are built in")
+	flag.Var(&setFlag, "set", "key=value for templates to read as .Env.key and with the env func, overriding the environment variable of that name. May be repeated")
+	flag.Var(&watchCommandFlag, "watch-command", "pattern:command to run with sh when a watched path matching the glob pattern changes, may be repeated")
+}
+
 type TemplateData struct {
-	URL    func(string) (string, error)
-	Active func(string) (bool, error)
+	URL     func(string) (string, error)
+	Active  func(string) (bool, error)
+	Page    map[string]interface{} // Front matter, nil if the page has none
+	Content template.HTML          // The page rendered outside of any define, for its layout to place
+	Pages   []*PageInfo            // Every page in the site, sorted by path
+	Term    *Term                  // For --taxonomy-template pages, the term they list
+	Terms   []*Term                // For --taxonomy-template and --terms-template pages, all of the taxonomy's terms
+	Globals interface{}            // The decoded --globals file or dir, nil without one
+	Env     map[string]string      // The --set values, a missing key being ""
+	Lang    string                 // The language the page is built in, "" without --languages
+}
+
+// PageInfo describes a page of the site for .Pages.
+type PageInfo struct {
+	Path  string                 // Relative to the input dir, slash separated
+	URL   string                 // Absolute, ready for .URL and .Active
+	Title string                 // The front matter title
+	Date  time.Time              // The front matter date, zero if it has none
+	Page  map[string]interface{} // All of the front matter
+	Lang  string                 // The language of this copy of the page, see --languages
+}
+
+// newPageInfo returns the PageInfo for the page at the input-relative relPath, built at the
+// output-relative outRelPath in lang.
+func newPageInfo(relPath, outRelPath, lang string, page map[string]interface{}) *PageInfo {
+	info := &PageInfo{
+		Path: filepath.ToSlash(relPath),
+		URL:  "/" + filepath.ToSlash(outRelPath),
+		Page: page,
+		Lang: lang,
+	}
+	if (*indexDirURLsFlag || *prettyURLsFlag) && strings.HasSuffix(info.URL, "/index.html") {
+		info.URL = strings.TrimSuffix(info.URL, "index.html")
+	}
+	if title, ok := page["title"]; ok {
+		info.Title = fmt.Sprint(title)
+	}
+	if date, ok := page["date"]; ok {
+		info.Date, _ = parseDate(date)
+	}
+	return info
+}
+
+// parseDate returns v if it's a time.Time, or else parses it as an RFC3339 or 2006-01-02 string,
+// the ways front matter dates are written.
+func parseDate(v interface{}) (time.Time, error) {
+	switch date := v.(type) {
+	case time.Time:
+		return date, nil
+	case string:
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if t, err := time.Parse(layout, date); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("%q isn't an RFC3339 or 2006-01-02 date", date)
+	default:
+		return time.Time{}, fmt.Errorf("%v is a %T, not a date", v, v)
+	}
+}
+
+// Lookup returns one of the fields by name (case insensitively), or else the front matter at key,
+// so lists of pages can be sorted and filtered by any front matter key (e.g. sortBy "weight").
+// An unset Title or Date counts as missing.
+func (p *PageInfo) Lookup(key string) (interface{}, bool) {
+	switch strings.ToLower(key) {
+	case "path":
+		return p.Path, true
+	case "url":
+		return p.URL, true
+	case "title":
+		return p.Title, p.Title != ""
+	case "date":
+		return p.Date, !p.Date.IsZero()
+	case "page":
+		return p.Page, true
+	case "lang":
+		return p.Lang, p.Lang != ""
+	}
+	v, ok := p.Page[key]
+	return v, ok
+}
+
+// buildFile is a file or dir in the input dir, collected before anything is rendered.
+type buildFile struct {
+	path       string
+	relPath    string
+	outRelPath string // Differs from relPath for preprocessed files, without any lang
+	outPath    string
+	lang       string // See --languages, for pages
+	info       os.FileInfo
+	static     bool          // From --static, always copied as is
+	pre        *preprocessor // From Preprocessors, if its extension has one
+	page       *PageInfo     // Only for files executed as templates
+	body       []byte        // The page's template, without front matter
+	skip       bool          // Failed while collecting
+}
+
+// site is what build collected that a page's links are checked against.
+type site struct {
+	redirects    map[string]string // See --redirects
+	rewrites     map[string]string // For --rewrite-redirects, the redirectKey of old paths to new paths
+	preprocessed map[string]string // Input dir paths of preprocessed output to their source, e.g. src/about.html to src/about.md
+	generated    map[string]bool   // Input dir paths of generated pages, e.g. src/tags/go/index.html
+	pretty       map[string]string // For --pretty-urls, input dir paths of pages (and their dirs) to where they're built, e.g. src/about.html and src/about to /about/index.html
+	pages        map[string]bool   // Input dir paths of the pages built once per --languages, generated ones included
+	globals      interface{}       // See --globals
+}
+
+// templateData returns TemplateData with the URL and Active funcs for the page built at the
+// output-relative outRelPath in lang. Links to other pages go to their copy in lang.
+func (s *site) templateData(outRelPath, lang string) (*TemplateData, error) {
+	rootPath, err := filepath.Rel(filepath.Dir(filepath.Join(*inFlag, lang, outRelPath)), *inFlag)
+	if err != nil {
+		return nil, err
+	}
+	// Relative URLs are relative to the page's dir in the input dir, which --pretty-urls moves it
+	// down from
+	linkDir := filepath.Dir(outRelPath)
+	if _, ok := s.pretty[filepath.Join(*inFlag, linkDir)]; ok {
+		linkDir = filepath.Dir(linkDir)
+	}
+	return &TemplateData{
+		Globals: s.globals,
+		Env:     setValues,
+		Lang:    lang,
+		URL: func(url string) (string, error) {
+			if *rewriteFlag {
+				url = s.rewriteURL(url, "")
+			}
+			if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+				return url, nil
+			}
+			// Any query or fragment is kept as is after the resolved path
+			suffix := ""
+			if i := strings.IndexAny(url, "?#"); i >= 0 {
+				url, suffix = url[:i], url[i:]
+			}
+			fromSlash := filepath.FromSlash(url)
+			if !filepath.IsAbs(fromSlash) {
+				// Relative to the page's dir, from there on treated as absolute
+				joined := filepath.Join(linkDir, fromSlash)
+				if !withinDir(".", joined) {
+					return "", fmt.Errorf("URL %s in %s resolves outside %s", url, filepath.ToSlash(outRelPath), *inFlag)
+				}
+				fromSlash = string(filepath.Separator) + joined
+			}
+			stat := filepath.Join(*inFlag, fromSlash)
+			if pretty, ok := s.pretty[stat]; ok {
+				fromSlash = filepath.FromSlash(pretty)
+				stat = filepath.Join(*inFlag, fromSlash)
+			}
+			if source, ok := s.preprocessed[stat]; ok {
+				stat = source
+			}
+			// Generated pages have nothing in the input dir to check
+			if !s.generated[stat] && !s.generated[filepath.Join(stat, "index.html")] {
+				root := *inFlag
+				if _, err := os.Stat(stat); os.IsNotExist(err) && *staticFlag != "" {
+					staticStat := filepath.Join(*staticFlag, fromSlash)
+					if _, err := os.Stat(staticStat); err == nil {
+						root, stat = *staticFlag, staticStat
+					}
+				}
+				if *strictURLsFlag {
+					if err := checkStrictURL(url, root, stat); err != nil {
+						return "", err
+					}
+				}
+				info, err := os.Stat(stat)
+				if err != nil {
+					return "", err
+				}
+				if *strictCaseFlag {
+					if err := checkCase(url, root, stat); err != nil {
+						return "", err
+					}
+				}
+				if info.IsDir() {
+					index := filepath.Join(stat, "index.html")
+					if source, ok := s.preprocessed[index]; ok {
+						index = source
+					}
+					if _, err := os.Stat(index); err != nil {
+						return "", err
+					}
+				}
+			}
+			href := filepath.ToSlash(filepath.Join(rootPath, filepath.FromSlash(s.localize(filepath.ToSlash(fromSlash), lang))))
+			if (*indexDirURLsFlag || *prettyURLsFlag) && (href == "index.html" || strings.HasSuffix(href, "/index.html")) {
+				href = strings.TrimSuffix(href, "index.html")
+				if href == "" {
+					href = "./"
+				}
+			}
+			if *stripHTMLExtFlag && strings.HasSuffix(href, ".html") {
+				// The file keeps it, for hosts that serve /about from about.html
+				href = strings.TrimSuffix(href, ".html")
+			}
+			return href + suffix, nil
+		},
+		Active: func(url string) (bool, error) {
+			if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+				return false, nil
+			}
+			if !filepath.IsAbs(filepath.FromSlash(url)) {
+				// Relative to the page's dir, made absolute keeping any trailing slash
+				joined := filepath.Join(linkDir, filepath.FromSlash(url))
+				if !withinDir(".", joined) {
+					return false, fmt.Errorf("URL %s in %s resolves outside %s", url, filepath.ToSlash(outRelPath), *inFlag)
+				}
+				abs := "/" + filepath.ToSlash(joined)
+				if joined == "." {
+					abs = "/"
+				} else if strings.HasSuffix(url, "/") {
+					abs += "/"
+				}
+				url = abs
+			}
+			if pretty, ok := s.pretty[filepath.Join(*inFlag, filepath.FromSlash(url))]; ok {
+				url = pretty
+			}
+			// An index page stands for its whole dir, except the root one for just itself
+			if strings.HasSuffix(url, "/index.html") {
+				url = strings.TrimSuffix(url, "index.html")
+			}
+			if url == "/" {
+				return outRelPath == "index.html", nil
+			}
+			return strings.HasPrefix(outRelPath, strings.TrimPrefix(filepath.FromSlash(url), string(filepath.Separator))), nil
+		},
+	}, nil
+}
+
+// redirectKey returns the absolute path p cleaned, and without any trailing slash or index.html,
+// for matching links to --redirects whichever way they name the page.
+func redirectKey(p string) string {
+	p = strings.TrimSuffix(path.Clean(p), "/index.html")
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// rewriteURL returns link with its path replaced by the new one if it's an old path in
+// --redirects, keeping the link's query and fragment, localized to lang. Links that aren't
+// absolute paths are returned as is.
+func (s *site) rewriteURL(link, lang string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return link
+	}
+	to, ok := s.rewrites[redirectKey(u.Path)]
+	if !ok {
+		return link
+	}
+	target, err := url.Parse(to)
+	if err != nil {
+		return link
+	}
+	if target.Scheme == "" && target.Host == "" {
+		target.Path = s.localize(target.Path, lang)
+	}
+	if u.RawQuery != "" {
+		target.RawQuery = u.RawQuery
+	}
+	if u.Fragment != "" {
+		target.Fragment, target.RawFragment = u.Fragment, u.RawFragment
+	}
+	return target.String()
+}
+
+// linkAttrRegexp matches the attributes of html tags that link to a URL, with the URL quoted in
+// either the second or the third group.
+var linkAttrRegexp = regexp.MustCompile(`(?i)(\s(?:href|src|action)\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// rewriteLinks returns the html out with the links in it to old paths in --redirects rewritten
+// to their new paths in lang, see rewriteURL.
+func (s *site) rewriteLinks(out []byte, lang string) []byte {
+	return linkAttrRegexp.ReplaceAllFunc(out, func(attr []byte) []byte {
+		m := linkAttrRegexp.FindSubmatch(attr)
+		quote, link := `"`, m[2]
+		if m[3] != nil {
+			quote, link = "'", m[3]
+		}
+		return []byte(string(m[1]) + quote + s.rewriteURL(string(link), lang) + quote)
+	})
+}
+
+// localize returns the absolute url path with lang prefixed if it's one of the pages built once
+// per --languages, as is otherwise.
+func (s *site) localize(url, lang string) string {
+	if lang == "" || !strings.HasPrefix(url, "/") {
+		return url
+	}
+	stat := filepath.Join(*inFlag, filepath.FromSlash(url))
+	if s.pages[stat] || s.pages[filepath.Join(stat, "index.html")] {
+		return langURL(lang, url)
+	}
+	return url
 }
 
 var TemplateFuncs = template.FuncMap{
-	"json": func(file string) (interface{}, error) {
-		data, err := ioutil.ReadFile(filepath.Join(*dataFlag, file))
+	"fetch": func(url string) (string, error) {
+		body, err := fetch(url)
+		return string(body), err
+	},
+	"getJSON": func(url string) (interface{}, error) {
+		body, err := fetch(url)
 		if err != nil {
 			return nil, err
 		}
 		var obj interface{}
-		return obj, json.Unmarshal(data, &obj)
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return nil, &DataError{url, fmt.Errorf("%s: %v", url, err)}
+		}
+		return obj, nil
 	},
 	"sprintf": func(format string, a ...interface{}) string {
 		return fmt.Sprintf(format, a...)
 	},
 	"uniq": func() string {
+		// Replaced by withPageFuncs for the page being executed
 		b := make([]byte, 16)
 		rand.Read(b)
 		return fmt.Sprintf("%x", b)
 	},
-	"read": func(file string) (string, error) {
-		data, err := ioutil.ReadFile(filepath.Join(*dataFlag, file))
+	"env": func(name string) string {
+		if v, ok := setValues[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	},
+	"now": func() time.Time {
+		return buildTime
+	},
+	"date": func(layout string, v interface{}) (string, error) {
+		t, err := parseDate(v)
 		if err != nil {
 			return "", err
 		}
-		return string(data), nil
+		// A layout without any of the reference time's elements formats every time the same
+		if layout != "" && time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC).Format(layout) == time.Date(2012, 11, 25, 15, 36, 47, 890, time.FixedZone("X", 3600)).Format(layout) {
+			return "", fmt.Errorf("date layout %q has no date or time in it, see https://pkg.go.dev/time#Layout", layout)
+		}
+		return t.Format(layout), nil
+	},
+	"glob": func(pattern string) ([]string, error) {
+		matches, err := filepath.Glob(filepath.Join(*inFlag, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("glob %s: %v", pattern, err)
+		}
+		// Relative to the input dir and slash separated, like .Pages paths
+		paths := []string{}
+		for _, match := range matches {
+			relPath, err := filepath.Rel(*inFlag, match)
+			if err != nil || relPath == "." || !withinDir(*inFlag, match) || ignored(relPath) {
+				continue
+			}
+			paths = append(paths, filepath.ToSlash(relPath))
+		}
+		sort.Strings(paths)
+		return paths, nil
+	},
+	"markdownString": func(v string) (template.HTML, error) {
+		out, err := markdown("markdownString", []byte(v))
+		return template.HTML(out), err
 	},
 	"html": func(v string) template.HTML {
 		return template.HTML(v)
 	},
+	"hexColor": func(v string) (template.CSS, error) {
+		c, err := parseColor(v)
+		return c.hex(), err
+	},
+	"lighten": func(amount float64, v string) (template.CSS, error) {
+		c, err := parseColor(v)
+		return c.lighten(amount).hex(), err
+	},
+	"darken": func(amount float64, v string) (template.CSS, error) {
+		c, err := parseColor(v)
+		return c.lighten(-amount).hex(), err
+	},
+	"rgba": func(alpha float64, v string) (template.CSS, error) {
+		c, err := parseColor(v)
+		return c.rgba(alpha), err
+	},
+	"sortBy":   sortBy,
+	"sort":     sortList,
+	"where":    where,
+	"first":    first,
+	"icon":     icon,
+	"slugify":  slugify,
+	"truncate": truncate,
+	"title":    titleCase,
+	"dump": func(v interface{}) (template.HTML, error) {
+		b, err := json.MarshalIndent(dumpValue(reflect.ValueOf(v)), "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return template.HTML("<pre>" + template.HTMLEscapeString(string(b)) + "</pre>"), nil
+	},
+	"writeFile": func(file string, content interface{}) (string, error) {
+		outPath := filepath.Join(*outFlag, filepath.FromSlash(file))
+		if !withinDir(*outFlag, outPath) {
+			return "", fmt.Errorf("%s is outside the output dir", file)
+		}
+		var data []byte
+		switch v := content.(type) {
+		case []byte:
+			data = v
+		case string:
+			data = []byte(v)
+		default:
+			data = []byte(fmt.Sprint(v))
+		}
+		if source, ok := outputSources[outPath]; ok {
+			return "", fmt.Errorf("%s is also built from %s", file, source)
+		}
+		sideFilesMu.Lock()
+		if sideFiles[outPath] {
+			sideFilesMu.Unlock()
+			return "", fmt.Errorf("%s was already written during this build", file)
+		}
+		sideFiles[outPath] = true
+		sideFilesMu.Unlock()
+		if err := Output.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return "", err
+		}
+		verboseLogger.Printf("Writing side file: %s", outPath)
+		return "", writeOutputFile(outPath, data, 0644)
+	},
+	"partial": func(name string, data interface{}) (template.HTML, error) {
+		// Replaced by withPageFuncs for the page being executed
+		return "", errors.New("only available while executing a page")
+	},
+	"include": func(name string, data interface{}) (template.HTML, error) {
+		// Replaced by withPageFuncs for the page being executed
+		return "", errors.New("only available while executing a page")
+	},
+	"T": func(key string, args ...interface{}) (string, error) {
+		// Replaced by withPageFuncs for the page being executed
+		return "", errors.New("only available while executing a page")
+	},
+	"asset": func(url string) (string, error) {
+		built, ok := assets["/"+strings.TrimPrefix(url, "/")]
+		if !ok {
+			return "", fmt.Errorf("asset %s isn't a file in the input or static dir", url)
+		}
+		return built, nil
+	},
+	"pathBetween": func(from, to string) (string, error) {
+		fromOut, ok := outRelPaths[strings.TrimPrefix(from, "/")]
+		if !ok {
+			return "", fmt.Errorf("no file %s in the input dir", from)
+		}
+		toOut, ok := outRelPaths[strings.TrimPrefix(to, "/")]
+		if !ok {
+			return "", fmt.Errorf("no file %s in the input dir", to)
+		}
+		rel, err := filepath.Rel(filepath.Dir(filepath.FromSlash(fromOut)), filepath.FromSlash(toOut))
+		return filepath.ToSlash(rel), err
+	},
 }
 
-var (
-	logPrefix       = os.Args[0] + ": "
-	verboseLogger   = log.New(ioutil.Discard, logPrefix, log.LstdFlags)
-	errLogger       = log.New(os.Stderr, logPrefix, log.LstdFlags)
-	maxOpenInLimit  = make(chan struct{})
-	maxOpenOutLimit = make(chan struct{})
-)
+// withPageFuncs binds the data funcs (see dataFuncs), partial, include, uniq, and T funcs to t, the
+// template set of the page at the input-relative relPath being executed at the output-relative
+// outRelPath in lang, and returns t. partial (or include, the same) executes the named template with
+// data, e.g. {{partial "card" .}}, and for --template-error-mode placeholder shows an error in its
+// place instead of failing the page. With a --seed or pinned build time (see
+// --build-time), uniq derives its ids from it, the page, and how many it has returned so far instead
+// of at random. T translates a message into lang, e.g. {{T "nav.home"}} or {{T "posts.count" 3}}.
+func withPageFuncs(t *template.Template, relPath, outRelPath, lang string) *template.Template {
+	uniqs := 0
+	partial := func(name string, data interface{}) (template.HTML, error) {
+		b := bytes.Buffer{}
+		err := fmt.Errorf("no template %q in --templates or the page", name)
+		if t.Lookup(name) != nil {
+			err = t.ExecuteTemplate(&b, name, data)
+		}
+		if err != nil {
+			if *templateErrorModeFlag != "placeholder" {
+				return "", err
+			}
+			errLogger.Printf("Rendering error placeholder for %s: %v", name, err)
+			return template.HTML(`<pre class="template-error">` + template.HTMLEscapeString(err.Error()) + `</pre>`), nil
+		}
+		return template.HTML(b.String()), nil
+	}
+	t.Funcs(dataFuncs(filepath.Dir(relPath)))
+	return t.Funcs(template.FuncMap{
+		"T": func(key string, args ...interface{}) (string, error) {
+			return translate(lang, key, args...)
+		},
+		"uniq": func() string {
+			seed := *seedFlag
+			if seed == "" && !pinnedTime.IsZero() {
+				seed = strconv.FormatInt(pinnedTime.Unix(), 10)
+			}
+			if seed == "" {
+				b := make([]byte, 16)
+				rand.Read(b)
+				return fmt.Sprintf("%x", b)
+			}
+			uniqs++
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%s %s %d", seed, filepath.ToSlash(filepath.Join(lang, outRelPath)), uniqs)))
+			return fmt.Sprintf("%x", sum[:16])
+		},
+		"partial": partial,
+		"include": partial,
+	})
+}
 
-func main() {
-	// Flag setup
-	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, usagePrefix)
-		flag.PrintDefaults()
+// ExtTemplateFuncs are merged on top of TemplateFuncs for pages with the given file extension. Only
+// the page itself can use them, not the base or other shared templates.
+var ExtTemplateFuncs = map[string]template.FuncMap{
+	".xml": {
+		"rssDate": func(v interface{}) (string, error) {
+			switch t := v.(type) {
+			case time.Time:
+				return t.Format(time.RFC1123Z), nil
+			case string:
+				parsed, err := time.Parse(time.RFC3339, t)
+				if err != nil {
+					return "", err
+				}
+				return parsed.Format(time.RFC1123Z), nil
+			default:
+				return "", fmt.Errorf("rssDate expects a time or RFC3339 string, got %T", v)
+			}
+		},
+	},
+}
+
+// sectionLayout returns the name of the template to use instead of the base for the page at the
+// input-relative relPath, the template named after its closest dir (e.g. "recipes" or
+// "recipes/desserts"), or "" if there isn't one.
+func sectionLayout(tmpl *template.Template, relPath string) string {
+	for dir := filepath.Dir(relPath); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if name := filepath.ToSlash(dir); tmpl.Lookup(name) != nil {
+			return name
+		}
 	}
-	flag.Parse()
+	return ""
+}
 
-	// Logger setup
-	if *verboseFlag {
-		verboseLogger = log.New(os.Stdout, logPrefix, log.LstdFlags)
+// parsePage parses the body of the page at path into t, with its ExtTemplateFuncs.
+func parsePage(t *template.Template, path string, body []byte) error {
+	if funcs, ok := ExtTemplateFuncs[filepath.Ext(path)]; ok {
+		t.Funcs(funcs)
 	}
-	maxOpenInLimit = make(chan struct{}, *maxOpenFlag/2)
-	maxOpenOutLimit = make(chan struct{}, *maxOpenFlag/2)
+	return parseAs(t, filepath.Base(path), string(body))
+}
 
-	// Build once
-	build(func(err error) {
-		errLogger.Panic(err)
-	})
+// templateTrees returns the parse tree of each template in t by name, to compare against after
+// parsing more into t, see overridesTemplates.
+func templateTrees(t *template.Template) map[string]*parse.Tree {
+	trees := map[string]*parse.Tree{}
+	for _, tt := range t.Templates() {
+		trees[tt.Name()] = tt.Tree
+	}
+	return trees
+}
 
-	wg := sync.WaitGroup{}
-	if *addrFlag != "" {
-		// Serve at addr if provided
-		wg.Add(1)
-		go func() {
-			defer wg.Add(-1)
-			verboseLogger.Printf("Serving %s on %s", *outFlag, *addrFlag)
-			if err := http.ListenAndServe(*addrFlag, http.FileServer(http.Dir(*outFlag))); err != nil {
-				errLogger.Panic(err)
-			}
-		}()
+// overridesTemplates reports whether any of the templates in trees has since been redefined in t.
+func overridesTemplates(trees map[string]*parse.Tree, t *template.Template) bool {
+	for name, tree := range trees {
+		if tt := t.Lookup(name); tt != nil && tt.Tree != tree {
+			return true
+		}
+	}
+	return false
+}
 
-		// Listen for changes
-		wg.Add(1)
-		go func() {
-			defer wg.Add(-1)
-			prevModTime := time.Now()
-			for {
-				rebuild := false
-				checkChange := func(path string, info os.FileInfo) {
-					if info.ModTime().After(prevModTime) {
-						verboseLogger.Printf("Change detected in %s", path)
-						rebuild = true
-						prevModTime = info.ModTime()
-					}
-				}
-				for _, path := range append([]string{
-					*inFlag,
-					*dataFlag,
-				}, strings.Fields(*templatesFlag)...) {
-					info, err := os.Stat(path)
-					if err != nil {
-						errLogger.Print(err)
-						break
-					}
-					if info.IsDir() {
-						if err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-							if err != nil {
-								return err
-							}
-							checkChange(path, info)
-							return nil
-						}); err != nil {
-							errLogger.Print(err)
-							break
-						}
-					} else {
-						checkChange(path, info)
-					}
-				}
-				if rebuild {
-					build(func(err error) {
-						errLogger.Print(err)
-					})
-				}
-				time.Sleep(time.Second)
+// usesField reports whether the template parse tree under node refers to .name anywhere.
+func usesField(node parse.Node, name string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if usesField(child, name) {
+				return true
 			}
-		}()
+		}
+	case *parse.ActionNode:
+		return usesField(n.Pipe, name)
+	case *parse.IfNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.RangeNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.WithNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.TemplateNode:
+		return usesField(n.Pipe, name)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if usesField(cmd, name) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if usesField(arg, name) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && n.Ident[0] == name
+	case *parse.ChainNode:
+		return usesField(n.Node, name) || (len(n.Field) > 0 && n.Field[0] == name)
+	case *parse.VariableNode:
+		// $.Content
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == name
 	}
+	return false
+}
 
-	wg.Wait()
+// parseAs parses text into t's template set the way ParseFiles would parse a file with the base
+// name name.
+func parseAs(t *template.Template, name, text string) error {
+	if name != t.Name() {
+		t = t.New(name)
+	}
+	_, err := t.Parse(text)
+	return err
 }
 
-func build(errLogFunc func(error)) {
-	// Templates setup
-	templatesFields := strings.Fields(*templatesFlag)
-	if len(templatesFields) < 1 {
-		errLogFunc(errors.New("--templates requires at least the base template"))
-		return
+// parseTemplates parses the contents of the template files paths, in order, into a set named
+// after the first, the base template.
+func parseTemplates(paths []string, contents [][]byte) (*template.Template, error) {
+	tmpl := template.New(filepath.Base(paths[0])).Funcs(TemplateFuncs)
+	for i, path := range paths {
+		if err := parseAs(tmpl, filepath.Base(path), string(contents[i])); err != nil {
+			return nil, &ParseError{path, err}
+		}
+		if i == 0 {
+			verboseLogger.Printf("Parsed base template: %s", path)
+		} else {
+			verboseLogger.Printf("Parsed template: %s", path)
+		}
 	}
-	tmpl, err := template.New(filepath.Base(templatesFields[0])).Funcs(TemplateFuncs).ParseFiles(templatesFields[0])
-	if err != nil {
-		errLogFunc(err)
-		return
+	return tmpl, nil
+}
+
+// frontMatterFormats maps each front matter fence to the decoder for what it fences.
+var frontMatterFormats = map[string]func([]byte, interface{}) error{
+	"---": yaml.Unmarshal,
+	"+++": toml.Unmarshal,
+}
+
+// splitFrontMatter splits the front matter, YAML fenced by "---" lines or TOML fenced by "+++"
+// lines, off the start of content. The front matter is returned decoded (nil if there isn't any)
+// along with the rest of content.
+func splitFrontMatter(path string, content []byte) (map[string]interface{}, []byte, error) {
+	text := string(content)
+	firstLine := text
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		firstLine = text[:i]
 	}
-	verboseLogger.Printf("Parsed base template: %s", templatesFields[0])
-	for _, path := range templatesFields[1:] {
-		info, err := os.Stat(path)
-		if err != nil {
-			errLogFunc(err)
-			return
+	fence := strings.TrimRight(firstLine, "\r")
+	unmarshal, ok := frontMatterFormats[fence]
+	if !ok {
+		return nil, content, nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimRight(lines[i], "\r\n") != fence {
+			continue
 		}
-		if info.IsDir() {
-			if err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !info.IsDir() {
-					tmpl, err = tmpl.ParseFiles(path)
-					if err != nil {
-						return err
-					}
-				}
-				return nil
-			}); err != nil {
-				errLogFunc(err)
-				return
-			}
-		} else {
-			tmpl, err = tmpl.ParseFiles(path)
-			if err != nil {
-				errLogFunc(err)
-				return
-			}
+		page := map[string]interface{}{}
+		if err := unmarshal([]byte(strings.Join(lines[1:i], "")), &page); err != nil {
+			return nil, nil, fmt.Errorf("%s: front matter: %v", path, err)
 		}
-		verboseLogger.Printf("Parsed templates: %s", path)
+		return page, []byte(strings.Join(lines[i+1:], "")), nil
 	}
+	return nil, nil, fmt.Errorf("%s: front matter has no closing %s", path, fence)
+}
 
-	// Render the files
-	if err := os.RemoveAll(*outFlag); err != nil {
-		errLogFunc(err)
-		return
+// retry runs op, and for --retry more attempts with a doubling delay after each, until it succeeds
+// or fails with a missing file or permission error, which trying again won't fix.
+func retry(op func() error) error {
+	delay := *retryDelayFlag
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= *retryFlag || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+			return err
+		}
+		errLogger.Printf("Retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
 	}
+}
+
+// readFiles reads the files concurrently, respecting --max-open, returning their contents in the
+// same order.
+func readFiles(paths []string) ([][]byte, error) {
+	contents := make([][]byte, len(paths))
+	errs := make([]error, len(paths))
 	wg := sync.WaitGroup{}
-	if err := filepath.Walk(*inFlag, func(path string, info os.FileInfo, err error) error {
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Add(-1)
+			maxOpenLimit.acquire(1)
+			defer maxOpenLimit.release(1)
+			if errs[i] = retry(func() (err error) {
+				contents[i], err = ioutil.ReadFile(path)
+				return err
+			}); errs[i] != nil {
+				errs[i] = &IOError{path, errs[i]}
+			}
+		}(i, path)
+	}
+	wg.Wait()
+	for _, err := range errs {
 		if err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// checkStrictURL enforces --strict-urls for url, which resolved to the path stat in dir
+// (the input or --static dir).
+func checkStrictURL(url, dir, stat string) error {
+	if !withinDir(dir, stat) {
+		return fmt.Errorf("URL %s resolves outside %s", url, dir)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(stat)
+	if err != nil {
+		return err
+	}
+	if !withinDir(root, real) {
+		return fmt.Errorf("URL %s resolves outside %s through a symlink", url, dir)
+	}
+	if strings.HasSuffix(url, "/") {
+		if info, err := os.Stat(real); err != nil {
 			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("URL %s expects a page dir but %s is a file", url, stat)
 		}
-		relPath, err := filepath.Rel(*inFlag, path)
+	}
+	return nil
+}
+
+// checkCase returns an error if the case of the existing path stat, a file or dir in root (the
+// input or --static dir), differs from the names on disk, which a case insensitive filesystem
+// would have let pass.
+func checkCase(url, root, stat string) error {
+	rel, err := filepath.Rel(root, stat)
+	if err != nil || rel == "." {
+		return err
+	}
+	dir := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		entries, err := ioutil.ReadDir(dir)
 		if err != nil {
 			return err
 		}
-		outPath := filepath.Join(*outFlag, relPath)
-		if info.IsDir() {
-			// Make the dir
-			verboseLogger.Printf("Creating dir: %s", outPath)
-			if err := os.Mkdir(outPath, info.Mode()); err != nil {
-				return err
+		found := ""
+		for _, entry := range entries {
+			if entry.Name() == name {
+				found = name
+				break
+			} else if strings.EqualFold(entry.Name(), name) {
+				found = entry.Name()
 			}
-		} else {
-			// Otherwise execute the template or copy the file, whichever is appropriate.
-			// Do them all in parallel
-			wg.Add(1)
-			go func(path string, outPath string, info os.FileInfo) {
-				defer wg.Add(-1)
-				maxOpenOutLimit <- struct{}{}
-				outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE, info.Mode())
-				defer func() {
-					if outFile != nil {
-						outFile.Close()
-					}
-					<-maxOpenOutLimit
-				}()
-				if err != nil {
-					errLogFunc(err)
-					return
-				}
-				rootPath, err := filepath.Rel(filepath.Dir(path), *inFlag)
-				if err != nil {
-					errLogFunc(err)
-					return
-				}
-				if tmpl != nil && filepath.Ext(path) == ".html" {
-					verboseLogger.Printf("Executing template: %s", path)
-					tmpl2, err := tmpl.Clone()
-					if err != nil {
-						errLogFunc(err)
+		}
+		if found != name {
+			return fmt.Errorf("URL %s doesn't match the case of %s", url, filepath.Join(dir, found))
+		}
+		dir = filepath.Join(dir, name)
+	}
+	return nil
+}
+
+// dumpValue converts v to something json can marshal, funcs become a placeholder with their type.
+func dumpValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return dumpValue(v.Elem())
+	case reflect.Func, reflect.Chan:
+		if v.IsNil() {
+			return nil
+		}
+		return fmt.Sprintf("<%s>", v.Type())
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return t
+		}
+		m := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.PkgPath == "" {
+				m[field.Name] = dumpValue(v.Field(i))
+			}
+		}
+		return m
+	case reflect.Map:
+		m := map[string]interface{}{}
+		for _, key := range v.MapKeys() {
+			m[fmt.Sprint(key.Interface())] = dumpValue(v.MapIndex(key))
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes())
+		}
+		a := make([]interface{}, v.Len())
+		for i := range a {
+			a[i] = dumpValue(v.Index(i))
+		}
+		return a
+	default:
+		return v.Interface()
+	}
+}
+
+// templateTimes sums execution time per template name for --profile-templates. Go templates
+// can't be instrumented from the inside, so each entry is its template's time including whatever
+// it calls.
+type templateTimes struct {
+	mu    sync.Mutex
+	times map[string]*templateTime
+}
+
+type templateTime struct {
+	name  string
+	calls int
+	total time.Duration
+}
+
+var templateProfile = &templateTimes{times: map[string]*templateTime{}}
+
+func (t *templateTimes) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.times = map[string]*templateTime{}
+}
+
+func (t *templateTimes) record(name string, d time.Duration) {
+	if !*profileTemplatesFlag {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tt, ok := t.times[name]
+	if !ok {
+		tt = &templateTime{name: name}
+		t.times[name] = tt
+	}
+	tt.calls++
+	tt.total += d
+}
+
+// print writes the breakdown to w, slowest first.
+func (t *templateTimes) print(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	times := []*templateTime{}
+	for _, tt := range t.times {
+		times = append(times, tt)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].total > times[j].total
+	})
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TEMPLATE\tCALLS\tTOTAL\tAVG")
+	for _, tt := range times {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", tt.name, tt.calls, tt.total, tt.total/time.Duration(tt.calls))
+	}
+	tw.Flush()
+}
+
+// searchEntries collects the pages for --search-index.
+type searchEntries struct {
+	mu      sync.Mutex
+	entries []searchEntry
+}
+
+type searchEntry struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Content string `json:"content"`
+}
+
+var searchIndex = &searchEntries{}
+
+var (
+	titleRegexp       = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	mainRegexp        = regexp.MustCompile(`(?is)<main[^>]*>(.*)</main>`)
+	scriptStyleRegexp = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	tagRegexp         = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+func (s *searchEntries) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = nil
+}
+
+// add indexes the page at the absolute url, as .Pages links to it. The title comes from the front
+// matter, or the rendered <title>, and the text from the page's own content, or the rendered
+// <main>, or the whole rendered page.
+func (s *searchEntries) add(url string, page map[string]interface{}, content template.HTML, rendered []byte) {
+	entry := searchEntry{URL: url}
+	if title, ok := page["title"]; ok {
+		entry.Title = fmt.Sprint(title)
+	} else if m := titleRegexp.FindSubmatch(rendered); m != nil {
+		entry.Title = plainText(string(m[1]))
+	}
+	if strings.TrimSpace(string(content)) != "" {
+		entry.Content = plainText(string(content))
+	} else if m := mainRegexp.FindSubmatch(rendered); m != nil {
+		entry.Content = plainText(string(m[1]))
+	} else {
+		entry.Content = plainText(titleRegexp.ReplaceAllString(string(rendered), ""))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+}
+
+// write writes the index as a json array, sorted by URL so builds are reproducible.
+func (s *searchEntries) write(outPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sort.Slice(s.entries, func(i, j int) bool {
+		return s.entries[i].URL < s.entries[j].URL
+	})
+	b, err := marshalOutputJSON(s.entries)
+	if err != nil {
+		return err
+	}
+	verboseLogger.Printf("Writing search index: %s", outPath)
+	return writeOutputFile(outPath, b, 0644)
+}
+
+// marshalOutputJSON marshals v for a generated json output file, indented unless --compact-json.
+func marshalOutputJSON(v interface{}) ([]byte, error) {
+	if *compactJSONFlag {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// plainText strips the tags (and scripts and styles) from the html fragment v, returning its text
+// with whitespace collapsed.
+func plainText(v string) string {
+	v = scriptStyleRegexp.ReplaceAllString(v, " ")
+	v = tagRegexp.ReplaceAllString(v, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(v)), " ")
+}
+
+// banner returns the --banner comment for the output file outPath built from source, in the
+// comment syntax of the output's file type (e.g. html for post.md), or nil if it doesn't get one.
+func banner(source, outPath string, now time.Time) []byte {
+	if !*bannerFlag {
+		return nil
+	}
+	if !hasExt(outPath, *bannerExtFlag) {
+		return nil
+	}
+	var open, close string
+	switch filepath.Ext(outPath) {
+	case ".html", ".htm", ".svg":
+		open, close = "<!-- ", " -->"
+	case ".css", ".js":
+		open, close = "/* ", " */"
+	default:
+		return nil
+	}
+	text := strings.NewReplacer(
+		"{tool}", filepath.Base(os.Args[0]),
+		"{source}", filepath.ToSlash(source),
+		"{time}", now.Format(time.RFC3339),
+	).Replace(*bannerTextFlag)
+	// Don't let the text end the comment early
+	text = strings.ReplaceAll(text, strings.TrimSpace(close), "")
+	return []byte(open + text + close + "\n")
+}
+
+// bannerPrologs are what has to stay at the very start of a file, before any --banner, by how it
+// starts and ends.
+var bannerPrologs = []struct{ start, end string }{
+	{"<?xml", "?>"},        // svg
+	{"@charset \"", "\";"}, // css
+}
+
+// bannerOffset returns where in the start of a file, head, the --banner goes, after any byte order
+// mark and bannerPrologs (and a newline after them), or -1 if more of the file is needed to tell
+// unless it's all there is.
+func bannerOffset(head []byte, all bool) int {
+	bom := []byte("\xef\xbb\xbf")
+	start := 0
+	if bytes.HasPrefix(head, bom) {
+		start = len(bom)
+	} else if !all && len(head) < len(bom) && bytes.HasPrefix(bom, head) {
+		return -1
+	}
+	rest := head[start:]
+	for _, prolog := range bannerPrologs {
+		if !bytes.HasPrefix(rest, []byte(prolog.start)) {
+			if !all && bytes.HasPrefix([]byte(prolog.start), rest) {
+				return -1
+			}
+			continue
+		}
+		i := bytes.Index(rest, []byte(prolog.end))
+		if i < 0 {
+			// Malformed if it goes on much longer
+			if !all && len(rest) < 1024 {
+				return -1
+			}
+			return start
+		}
+		end := start + i + len(prolog.end)
+		if end == len(head) && !all {
+			return -1
+		}
+		if end < len(head) && head[end] == '\n' {
+			end++
+		}
+		return end
+	}
+	return start
+}
+
+// insertBanner returns content with the --banner b inserted at its bannerOffset.
+func insertBanner(b, content []byte) []byte {
+	if len(b) == 0 {
+		return content
+	}
+	i := bannerOffset(content, true)
+	return append(append(append([]byte{}, content[:i]...), b...), content[i:]...)
+}
+
+// bannerWriter inserts a --banner into what's written through it, holding back the start until its
+// bannerOffset is known.
+type bannerWriter struct {
+	io.WriteCloser
+	banner []byte // nil once written
+	head   []byte
+}
+
+func (w *bannerWriter) Write(p []byte) (int, error) {
+	if w.banner == nil {
+		return w.WriteCloser.Write(p)
+	}
+	w.head = append(w.head, p...)
+	if bannerOffset(w.head, false) < 0 {
+		return len(p), nil
+	}
+	return len(p), w.flush()
+}
+
+func (w *bannerWriter) flush() error {
+	out := insertBanner(w.banner, w.head)
+	w.banner, w.head = nil, nil
+	_, err := w.WriteCloser.Write(out)
+	return err
+}
+
+func (w *bannerWriter) Close() error {
+	if w.banner != nil {
+		if err := w.flush(); err != nil {
+			w.WriteCloser.Close()
+			return err
+		}
+	}
+	return w.WriteCloser.Close()
+}
+
+// fileLimit bounds the number of files open at once, for --max-open. Whatever needs more than
+// one file open takes them all at once, so nothing holds some while waiting for more.
+type fileLimit struct {
+	mu    sync.Mutex
+	slots chan struct{}
+}
+
+// newFileLimit returns a fileLimit of max files, at least 2 for copying a file.
+func newFileLimit(max int) *fileLimit {
+	if max < 2 {
+		max = 2
+	}
+	return &fileLimit{slots: make(chan struct{}, max)}
+}
+
+// acquire waits until n more files can be opened.
+func (l *fileLimit) acquire(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i < n; i++ {
+		l.slots <- struct{}{}
+	}
+}
+
+// release is called once the n files from acquire are closed.
+func (l *fileLimit) release(n int) {
+	for i := 0; i < n; i++ {
+		<-l.slots
+	}
+}
+
+// hasExt reports whether path ends in one of the extensions in the string separated list exts,
+// which may be compound like .min.js.
+func hasExt(path, exts string) bool {
+	for _, ext := range strings.Fields(exts) {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint adds the start of the hash of the content of f, a file copied as is, to its output
+// name, e.g. style.css to style.1a2b3c4d.css.
+func fingerprint(f *buildFile) error {
+	hash, err := hashFile(f.path)
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(f.outRelPath)
+	f.outRelPath = strings.TrimSuffix(f.outRelPath, ext) + "." + hash[:8] + ext
+	f.outPath = filepath.Join(*outFlag, f.lang, f.outRelPath)
+	return nil
+}
+
+// withinDir reports whether path is dir itself or lies somewhere beneath it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+var (
+	logPrefix     = os.Args[0] + ": "
+	verboseLogger = log.New(ioutil.Discard, logPrefix, log.LstdFlags)
+	errLogger     = log.New(os.Stderr, logPrefix, log.LstdFlags)
+	accessLogger  = log.New(ioutil.Discard, logPrefix, log.LstdFlags)
+	reportLogger  = log.New(reportWriter, logPrefix, log.LstdFlags)
+	reportWriter  = io.Writer(os.Stdout)
+	maxOpenLimit  = newFileLimit(1)
+	sideFilesMu   = sync.Mutex{}
+	sideFiles     = map[string]bool{}
+	outputSources = map[string]string{} // Output paths to what builds them, for this build
+	outRelPaths   = map[string]string{} // Slash separated, input to output relative, for this build
+	assets        = map[string]string{} // Absolute URLs of the files that aren't pages to theirs as built, for this build
+	pinnedTime    time.Time             // See --build-time, zero if not pinned
+	setValues     = map[string]string{} // See --set
+	buildTime     time.Time             // pinnedTime, or else when this build started
+)
+
+func main() {
+	// Flag setup
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usagePrefix)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *configFlag != "" {
+		if err := loadConfig(*configFlag); err != nil {
+			errLogger.Fatal(err)
+		}
+	}
+	if *printConfigFlag {
+		config := map[string]interface{}{}
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Name != "print-config" && f.Name != "config" {
+				config[f.Name] = f.Value.(flag.Getter).Get()
+			}
+		})
+		b, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			errLogger.Fatal(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+
+	// Logger setup
+	if *outFlag == "-" {
+		// Stdout is for the archive
+		reportWriter = os.Stderr
+	}
+	if *verboseFlag {
+		verboseLogger = log.New(reportWriter, logPrefix, log.LstdFlags)
+	}
+	reportLogger = log.New(reportWriter, logPrefix, log.LstdFlags)
+	// Unlike the other lists it may be comma separated
+	*templateExtFlag = strings.ReplaceAll(*templateExtFlag, ",", " ")
+	if *accessLogFlag {
+		accessLogger = log.New(os.Stdout, logPrefix, log.LstdFlags)
+	}
+	maxOpenLimit = newFileLimit(*maxOpenFlag)
+	if *templateErrorModeFlag != "fail" && *templateErrorModeFlag != "placeholder" {
+		errLogger.Fatalf("--template-error-mode must be fail or placeholder, not %s", *templateErrorModeFlag)
+	}
+	for _, set := range setFlag {
+		i := strings.Index(set, "=")
+		if i <= 0 {
+			errLogger.Fatalf("--set %s is not key=value", set)
+		}
+		setValues[set[:i]] = set[i+1:]
+	}
+	if (*tlsCertFlag == "") != (*tlsKeyFlag == "") {
+		errLogger.Fatal("--tls-cert and --tls-key must be used together")
+	}
+	for _, pattern := range strings.Fields(*ignoreFlag) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errLogger.Fatalf("--ignore %s: %v", pattern, err)
+		}
+	}
+	if *highlightStyleFlag != "" {
+		if err := useHighlightStyle(*highlightStyleFlag); err != nil {
+			errLogger.Fatal(err)
+		}
+	} else if *highlightCSSFlag != "" {
+		errLogger.Fatal("--highlight-css needs a --highlight-style")
+	}
+	if err := addMarkdownExts(*markdownExtFlag); err != nil {
+		errLogger.Fatal(err)
+	}
+	if err := addPreprocessors(preprocessFlag); err != nil {
+		errLogger.Fatal(err)
+	}
+	var err error
+	if pinnedTime, err = parseBuildTime(); err != nil {
+		errLogger.Fatal(err)
+	}
+	if baseURL, err = parseBaseURL(*baseURLFlag); err != nil {
+		errLogger.Fatal(err)
+	}
+
+	// Stream a tar archive of the output for --out -
+	var tarFS *TarFS
+	if *outFlag == "-" {
+		if *addrFlag != "" || *stateFlag != "" {
+			errLogger.Fatal("--out - can't be used with --addr or --state")
+		}
+		// There's no output dir to list
+		*manifestFlag = ""
+		tarFS = NewTarFS(os.Stdout, *outFlag)
+		tarFS.ModTime = pinnedTime
+		Output = tarFS
+	}
+
+	// Build into memory to compare with the current output for --diff and --dry-run
+	var diffFS *MemFS
+	if *diffFlag || *dryRunFlag {
+		if *addrFlag != "" || *outFlag == "-" || *stateFlag != "" || !*cleanFlag {
+			errLogger.Fatal("--diff and --dry-run can't be used with --addr, --out -, --state, or --clean=false")
+		}
+		diffFS = NewMemFS()
+		Output = diffFS
+	}
+
+	// Build once, failing unless there's a server to keep running
+	if result := build(); result.errs > 0 {
+		if *addrFlag == "" {
+			errLogger.Fatal(result)
+		}
+		errLogger.Print(result)
+	} else {
+		reportLogger.Print(result)
+	}
+	if tarFS != nil {
+		if err := tarFS.Close(); err != nil {
+			errLogger.Fatal(err)
+		}
+	}
+	if diffFS != nil {
+		changed, err := printDiff(reportWriter, diffFS)
+		if err != nil {
+			errLogger.Fatal(err)
+		}
+		if !changed {
+			fmt.Fprintln(reportWriter, "No changes")
+			return
+		}
+		if *dryRunFlag {
+			return
+		}
+		fmt.Fprintf(reportWriter, "Write these changes to %s? [y/N] ", *outFlag)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return
+		}
+		// Written beside the output dir, which is only replaced once it all is
+		staged, err := NewStagedFS(*outFlag)
+		if err == nil {
+			err = diffFS.CopyTo(staged)
+		}
+		if err == nil {
+			err = staged.Commit()
+		}
+		if err != nil {
+			staged.Discard()
+			errLogger.Fatal(err)
+		}
+		if err := chownOutput(); err != nil {
+			errLogger.Fatal(err)
+		}
+		return
+	}
+
+	if *addrFlag == "" {
+		return
+	}
+
+	// Serve at addr, rebuilding on changes, until interrupted. A second interrupt exits at once.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	handler := notFoundHandler(fileHandler(*outFlag), *outFlag)
+	if *serveInjectFlag != "" {
+		inject, err := ioutil.ReadFile(*serveInjectFlag)
+		if err != nil {
+			errLogger.Fatal(err)
+		}
+		handler = injectHandler(handler, inject)
+	}
+	if *liveReloadFlag {
+		handler = liveReloadHandler(handler)
+	}
+	if *cspFlag != "" {
+		handler = cspHandler(handler)
+	}
+	if *accessLogFlag {
+		handler = accessLogHandler(handler)
+	}
+	server := newServer(handler)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Add(-1)
+		var err error
+		if *tlsCertFlag != "" {
+			verboseLogger.Printf("Serving %s on https://%s", *outFlag, *addrFlag)
+			err = server.ListenAndServeTLS(*tlsCertFlag, *tlsKeyFlag)
+		} else {
+			verboseLogger.Printf("Serving %s on http://%s", *outFlag, *addrFlag)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			errLogger.Panic(err)
+		}
+	}()
+
+	// Listen for changes
+	wg.Add(1)
+	go func() {
+		defer wg.Add(-1)
+		rebuilds := &rebuilder{build: func() {
+			if result := build(); result.errs > 0 {
+				errLogger.Print(result)
+			} else {
+				reportLogger.Print(result)
+				if *liveReloadFlag {
+					liveReloads.reload()
+				}
+			}
+		}}
+		// Let a rebuild that's running finish writing the output dir before exiting
+		defer rebuilds.wait()
+		buildPaths := append([]string{
+			*inFlag,
+			*dataFlag,
+		}, strings.Fields(*templatesFlag)...)
+		for _, path := range []string{*iconsFlag, *i18nFlag} {
+			if _, err := os.Stat(path); err == nil {
+				buildPaths = append(buildPaths, path)
+			}
+		}
+		for _, path := range []string{*staticFlag, *globalsFlag} {
+			if path != "" {
+				buildPaths = append(buildPaths, path)
+			}
+		}
+		// Changes to --watch-paths only run --watch-command, they don't rebuild
+		watchPaths := append(append([]string{}, buildPaths...), strings.Fields(*watchPathsFlag)...)
+		if err := watch(ctx, watchPaths, *debounceFlag, *pollIntervalFlag, func(changed []string) {
+			for _, path := range changed {
+				if rel, err := filepath.Rel(*inFlag, path); err == nil && withinDir(*inFlag, path) && ignored(rel) {
+					continue
+				}
+				if withinAny(buildPaths, path) {
+					rebuilds.trigger()
+					break
+				}
+			}
+			runWatchCommands(changed)
+		}); err != nil {
+			errLogger.Panic(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	verboseLogger.Print("Shutting down, waiting for requests and rebuilds to finish")
+	liveReloads.close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		errLogger.Printf("Stopping the server: %v", err)
+	}
+	wg.Wait()
+}
+
+// rebuilder runs build one at a time, so two can't write the output dir at once. Triggering it
+// during a build queues one more to run after, however many times it's triggered.
+type rebuilder struct {
+	build   func()
+	mu      sync.Mutex
+	running bool
+	pending bool
+	done    sync.WaitGroup // Done when no build is running
+}
+
+// trigger starts a build, or queues one if one is running.
+func (r *rebuilder) trigger() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		r.pending = true
+		return
+	}
+	r.running = true
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		for {
+			r.build()
+			r.mu.Lock()
+			if !r.pending {
+				r.running = false
+				r.mu.Unlock()
+				return
+			}
+			r.pending = false
+			r.mu.Unlock()
+			verboseLogger.Print("Running the rebuild queued during the last one")
+		}
+	}()
+}
+
+// wait drops any queued build and waits for the one running, if any, to finish.
+func (r *rebuilder) wait() {
+	r.mu.Lock()
+	r.pending = false
+	r.mu.Unlock()
+	r.done.Wait()
+}
+
+// runWatchCommands runs each --watch-command whose pattern matches one of the changed paths, or
+// their base names, once.
+func runWatchCommands(changed []string) {
+	for _, watchCommand := range watchCommandFlag {
+		i := strings.Index(watchCommand, ":")
+		if i < 0 {
+			errLogger.Printf("--watch-command %s is not pattern:command", watchCommand)
+			continue
+		}
+		pattern, command := watchCommand[:i], watchCommand[i+1:]
+		matched := false
+		for _, path := range changed {
+			fullMatch, err := filepath.Match(pattern, path)
+			if err != nil {
+				errLogger.Printf("--watch-command %s: %v", watchCommand, err)
+				break
+			}
+			baseMatch, _ := filepath.Match(pattern, filepath.Base(path))
+			if matched = fullMatch || baseMatch; matched {
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		verboseLogger.Printf("Running watch command: %s", command)
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdout = &logWriter{logger: verboseLogger}
+		cmd.Stderr = &logWriter{logger: errLogger}
+		if err := cmd.Run(); err != nil {
+			errLogger.Printf("Watch command %s: %v", command, err)
+		}
+	}
+}
+
+// logWriter writes each line written to it to logger.
+type logWriter struct {
+	logger *log.Logger
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.Print(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// stringsFlag is a flag that can be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Get() interface{} {
+	return []string(*f)
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// buildResult counts what a build did.
+type buildResult struct {
+	pages    int32 // Pages executed, generated ones included
+	copied   int32 // Files copied or preprocessed
+	failed   int32 // Files that failed to build
+	errs     int32 // Every error, including ones not tied to a file
+	bytes    int64 // Written to the output
+	duration time.Duration
+}
+
+func (r buildResult) String() string {
+	s := fmt.Sprintf("Built %d pages, copied %d files, %s in %s", r.pages, r.copied, formatBytes(r.bytes), r.duration.Round(time.Millisecond))
+	if r.errs > 0 {
+		s += fmt.Sprintf(", with %d errors and %d files failed", r.errs, r.failed)
+	}
+	return s
+}
+
+// formatBytes returns n in B, kB, MB, or GB, whichever is the largest under n.
+func formatBytes(n int64) string {
+	if n < 1000 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, unit := float64(n)/1000, "kB"
+	for _, next := range []string{"MB", "GB"} {
+		if v < 1000 {
+			break
+		}
+		v, unit = v/1000, next
+	}
+	return fmt.Sprintf("%.1f %s", v, unit)
+}
+
+// outputBytes counts the bytes written to the output by the current build, see countingFile.
+var outputBytes int64
+
+// countingFile adds what's written to it to outputBytes.
+type countingFile struct {
+	io.WriteCloser
+}
+
+func (f countingFile) Write(p []byte) (int, error) {
+	n, err := f.WriteCloser.Write(p)
+	atomic.AddInt64(&outputBytes, int64(n))
+	return n, err
+}
+
+// build builds the site, logging each error and carrying on with whatever the error doesn't stop.
+func build() (result buildResult) {
+	start := time.Now()
+	failed := int32(0)
+	builtPages, copiedFiles, failedFiles := int32(0), int32(0), int32(0)
+	atomic.StoreInt64(&outputBytes, 0)
+	// Called once each file is done, for the result
+	fileDone := func(ok, page bool) {
+		switch {
+		case !ok:
+			atomic.AddInt32(&failedFiles, 1)
+		case page:
+			atomic.AddInt32(&builtPages, 1)
+		default:
+			atomic.AddInt32(&copiedFiles, 1)
+		}
+	}
+	errLogFunc := func(err error) {
+		// Past --max-errors they're only counted
+		if n := atomic.AddInt32(&failed, 1); *maxErrorsFlag <= 0 || n <= int32(*maxErrorsFlag) {
+			errLogger.Print(err)
+		}
+	}
+	tooManyErrors := func() bool {
+		return *maxErrorsFlag > 0 && atomic.LoadInt32(&failed) >= int32(*maxErrorsFlag)
+	}
+	defer func() {
+		result = buildResult{atomic.LoadInt32(&builtPages), atomic.LoadInt32(&copiedFiles), atomic.LoadInt32(&failedFiles), atomic.LoadInt32(&failed), atomic.LoadInt64(&outputBytes), time.Since(start)}
+		if tooManyErrors() {
+			errLogger.Printf("Stopped the build after --max-errors %d errors (%d more not shown)", *maxErrorsFlag, result.errs-int32(*maxErrorsFlag))
+		}
+	}()
+
+	// Templates setup
+	templatesFields := strings.Fields(*templatesFlag)
+	if len(templatesFields) < 1 {
+		errLogFunc(errors.New("--templates requires at least the base template"))
+		return
+	}
+	// Gather the template files, then read them all in parallel and parse them in order since a
+	// template set isn't safe for concurrent parsing
+	templateFiles := []string{templatesFields[0]}
+	for _, path := range templatesFields[1:] {
+		info, err := os.Stat(path)
+		if err != nil {
+			errLogFunc(&IOError{path, err})
+			return
+		}
+		if info.IsDir() {
+			if err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() {
+					templateFiles = append(templateFiles, path)
+				}
+				return nil
+			}); err != nil {
+				errLogFunc(&IOError{path, err})
+				return
+			}
+		} else {
+			templateFiles = append(templateFiles, path)
+		}
+	}
+	contents, err := readFiles(templateFiles)
+	if err != nil {
+		errLogFunc(err)
+		return
+	}
+	tmpl, err := parseTemplates(templateFiles, contents)
+	if err != nil {
+		errLogFunc(err)
+		return
+	}
+
+	if *strictHTMLEscapingFlag {
+		auditHTML(tmpl, nil)
+	}
+
+	layoutUsesContent := false
+	for _, t := range tmpl.Templates() {
+		layoutUsesContent = layoutUsesContent || (t.Tree != nil && usesField(t.Tree.Root, "Content"))
+	}
+
+	// Collect the files
+	redirects, err := readRedirects()
+	if err != nil {
+		errLogFunc(err)
+		return
+	}
+	globals, err := readGlobals()
+	if err != nil {
+		errLogFunc(err)
+		return
+	}
+	langs := languages()
+	if catalogs, err = readCatalogs(strings.Fields(*languagesFlag)); err != nil {
+		errLogFunc(err)
+		return
+	}
+	links := &site{redirects: redirects, preprocessed: map[string]string{}, generated: map[string]bool{}, pages: map[string]bool{}, pretty: map[string]string{}, globals: globals}
+	dirs, files := []*buildFile{}, []*buildFile{}
+	// The --static dir is walked after the input dir, just copying its files
+	collect := func(root string, static bool) func(string, os.FileInfo, error) error {
+		return func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if relPath != "." && ignored(relPath) {
+				verboseLogger.Printf("Ignoring: %s", path)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			f := &buildFile{path: path, relPath: relPath, outRelPath: relPath, info: info, static: static}
+			if pre, ok := Preprocessors[filepath.Ext(path)]; ok && !static && !info.IsDir() && !hasExt(path, *rawExtFlag) {
+				if pre.partials && strings.HasPrefix(info.Name(), "_") {
+					verboseLogger.Printf("Skipping partial: %s", path)
+					return nil
+				}
+				f.pre = &pre
+				f.outRelPath = strings.TrimSuffix(relPath, filepath.Ext(relPath)) + pre.ext
+				links.preprocessed[filepath.Join(*inFlag, f.outRelPath)] = path
+			}
+			if *prettyURLsFlag && f.isPage() && filepath.Ext(f.outRelPath) == ".html" && filepath.Base(f.outRelPath) != "index.html" && f.outRelPath != "404.html" {
+				prettyRelPath := filepath.Join(strings.TrimSuffix(f.outRelPath, ".html"), "index.html")
+				links.preprocessed[filepath.Join(*inFlag, prettyRelPath)] = path
+				links.pretty[filepath.Join(*inFlag, f.outRelPath)] = "/" + filepath.ToSlash(prettyRelPath)
+				links.pretty[filepath.Join(*inFlag, filepath.Dir(prettyRelPath))] = "/" + filepath.ToSlash(prettyRelPath)
+				f.outRelPath = prettyRelPath
+			}
+			if f.isPage() {
+				// Collected in the default language, see below for the others
+				f.lang = langs[0]
+				links.pages[filepath.Join(*inFlag, f.outRelPath)] = true
+			}
+			f.outPath = filepath.Join(*outFlag, f.lang, f.outRelPath)
+			if info.IsDir() {
+				dirs = append(dirs, f)
+			} else if *maxFileSizeFlag > 0 && info.Size() > *maxFileSizeFlag {
+				err := fmt.Errorf("%s is %d bytes, over --max-file-size %d", path, info.Size(), *maxFileSizeFlag)
+				switch *maxFileSizeModeFlag {
+				case "skip":
+					errLogger.Printf("Skipping file: %v", err)
+				case "fail":
+					errLogFunc(err)
+				default:
+					return fmt.Errorf("--max-file-size-mode must be skip or fail, not %s", *maxFileSizeModeFlag)
+				}
+			} else {
+				files = append(files, f)
+			}
+			return nil
+		}
+	}
+	if err := filepath.Walk(*inFlag, collect(*inFlag, false)); err != nil {
+		errLogFunc(&IOError{*inFlag, err})
+		return
+	}
+	if *staticFlag != "" {
+		if err := filepath.Walk(*staticFlag, collect(*staticFlag, true)); err != nil {
+			errLogFunc(&IOError{*staticFlag, err})
+			return
+		}
+	}
+
+	// Everything but pages is an asset, with copied files fingerprinted for --fingerprint-ext
+	builtAssets := map[string]string{}
+	for _, f := range files {
+		if f.isPage() {
+			continue
+		}
+		url := "/" + filepath.ToSlash(f.outRelPath)
+		if f.pre == nil && hasExt(f.path, *fingerprintExtFlag) {
+			if err := fingerprint(f); err != nil {
+				errLogFunc(&IOError{f.path, err})
+				return
+			}
+		}
+		builtAssets[url] = "/" + filepath.ToSlash(f.outRelPath)
+	}
+	assets = builtAssets
+
+	builtRelPaths := map[string]string{}
+	for _, f := range files {
+		builtRelPaths[filepath.ToSlash(f.relPath)] = filepath.ToSlash(filepath.Join(f.lang, f.outRelPath))
+	}
+	outRelPaths = builtRelPaths
+
+	// Every dir of pages is needed in each language
+	for _, lang := range langs {
+		if lang == "" {
+			continue
+		}
+		for _, f := range dirs {
+			if !f.static && f.lang == "" {
+				dirs = append(dirs, &buildFile{path: f.path, relPath: f.relPath, outRelPath: f.outRelPath, outPath: filepath.Join(*outFlag, lang, f.outRelPath), info: f.info, lang: lang})
+			}
+		}
+	}
+
+	// Read the pages up front so every page can see all of them in .Pages
+	pageFiles, pagePaths := []*buildFile{}, []string{}
+	for _, f := range files {
+		if f.isPage() {
+			pageFiles = append(pageFiles, f)
+			pagePaths = append(pagePaths, f.path)
+		}
+	}
+	pageContents, err := readFiles(pagePaths)
+	if err != nil {
+		errLogFunc(err)
+		return
+	}
+	pages := []*PageInfo{}
+	drafts := map[*buildFile]bool{}
+	for i, f := range pageFiles {
+		page, body, err := splitFrontMatter(f.path, pageContents[i])
+		if err != nil {
+			errLogFunc(&ParseError{f.path, err})
+			f.skip = true
+			continue
+		}
+		if page["draft"] == true && !*draftsFlag {
+			verboseLogger.Printf("Skipping draft: %s", f.path)
+			drafts[f] = true
+			continue
+		}
+		if page != nil && f.pre == nil {
+			// Blank lines in place of the front matter keep template error line numbers right
+			fenced := bytes.Count(pageContents[i][:len(pageContents[i])-len(body)], []byte("\n"))
+			body = append([]byte("{{/*"+strings.Repeat("\n", fenced)+"*/}}"), body...)
+		}
+		f.page, f.body = newPageInfo(f.relPath, f.outRelPath, f.lang, page), body
+		pages = append(pages, f.page)
+		// A copy of the page for each of the other languages
+		for _, lang := range langs[1:] {
+			c := *f
+			c.lang, c.outPath = lang, filepath.Join(*outFlag, lang, f.outRelPath)
+			c.page = newPageInfo(f.relPath, f.outRelPath, lang, page)
+			files = append(files, &c)
+			pages = append(pages, c.page)
+		}
+	}
+	if len(drafts) > 0 {
+		kept := []*buildFile{}
+		for _, f := range files {
+			if !drafts[f] {
+				kept = append(kept, f)
+			}
+		}
+		files = kept
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Path < pages[j].Path
+	})
+	langPages := map[string][]*PageInfo{}
+	for _, page := range pages {
+		langPages[page.Lang] = append(langPages[page.Lang], page)
+	}
+
+	// Aliases are redirects to the page
+	for _, f := range pageFiles {
+		if f.page == nil {
+			continue
+		}
+		for _, alias := range stringList(f.page.Page["aliases"]) {
+			if !strings.HasPrefix(alias, "/") {
+				errLogFunc(&DataError{f.path, fmt.Errorf("%s: alias %s must be an absolute path", f.path, alias)})
+			} else if to, ok := redirects[alias]; ok {
+				errLogFunc(&DataError{f.path, fmt.Errorf("%s: alias %s is already a redirect to %s", f.path, alias, to)})
+			} else {
+				redirects[alias] = f.page.URL
+			}
+		}
+	}
+	// With --languages nothing is built at the root, so it goes to the default language
+	if langs[0] != "" && links.pages[filepath.Join(*inFlag, "index.html")] {
+		if _, ok := redirects["/"]; !ok {
+			redirects["/"] = "/"
+		}
+	}
+
+	// Taxonomy pages, not in the input dir, for each language from its pages
+	taxonomies := strings.Fields(*taxonomiesFlag)
+	terms := map[string]map[string][]*Term{}
+	generated := map[string]string{} // By output-relative path with the language
+	addGenerated := func(lang, outRelPath, source string) {
+		if lang != "" {
+			source += " in " + lang
+		}
+		generated[filepath.Join(lang, outRelPath)] = source
+		links.generated[filepath.Join(*inFlag, outRelPath)] = true
+		links.pages[filepath.Join(*inFlag, outRelPath)] = true
+	}
+	for _, lang := range langs {
+		terms[lang] = collectTerms(taxonomies, langPages[lang])
+		for _, taxonomy := range taxonomies {
+			addGenerated(lang, filepath.Join(taxonomy, "index.html"), "taxonomy "+taxonomy)
+			for _, term := range terms[lang][taxonomy] {
+				addGenerated(lang, filepath.FromSlash(strings.TrimPrefix(term.URL, "/")), "taxonomy "+taxonomy+" term "+term.Name)
+			}
+		}
+	}
+
+	// Two sources for one output would race, with the winner changing between builds
+	sources := map[string]string{}
+	for _, f := range files {
+		if f.skip {
+			continue
+		}
+		if other, ok := sources[f.outPath]; ok {
+			errLogFunc(fmt.Errorf("%s and %s both build %s", other, f.path, f.outPath))
+			f.skip = true
+			continue
+		}
+		sources[f.outPath] = f.path
+	}
+	generatedPaths := []string{}
+	for outRelPath := range generated {
+		generatedPaths = append(generatedPaths, outRelPath)
+	}
+	sort.Strings(generatedPaths)
+	for _, outRelPath := range generatedPaths {
+		outPath := filepath.Join(*outFlag, outRelPath)
+		if other, ok := sources[outPath]; ok {
+			errLogFunc(fmt.Errorf("%s and %s both build %s", other, generated[outRelPath], outPath))
+			delete(generated, outRelPath)
+			continue
+		}
+		sources[outPath] = generated[outRelPath]
+	}
+	froms := []string{}
+	for from := range redirects {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		outPath, source := outputPagePath(from), "redirect from "+from
+		if other, ok := sources[outPath]; ok {
+			errLogFunc(fmt.Errorf("%s and %s both build %s", other, source, outPath))
+			delete(redirects, from)
+			continue
+		}
+		sources[outPath] = source
+	}
+	// The search index and manifest are written once the rest are built, so they'd replace a
+	// built file of the same name
+	searchIndexPath, manifestPath := *searchIndexFlag, *manifestFlag
+	for _, written := range []struct {
+		source     string
+		outRelPath *string
+	}{{"--search-index", &searchIndexPath}, {"--manifest", &manifestPath}} {
+		if *written.outRelPath == "" {
+			continue
+		}
+		outPath := filepath.Join(*outFlag, *written.outRelPath)
+		if other, ok := sources[outPath]; ok {
+			errLogFunc(fmt.Errorf("%s and %s both build %s", other, written.source, outPath))
+			*written.outRelPath = ""
+			continue
+		}
+		sources[outPath] = written.source
+	}
+	// While the sitemap, feeds, and highlight css are left to a built file of the same name
+	leftToBuilt := map[string]string{}
+	if baseURL != "" {
+		leftToBuilt["sitemap.xml"] = "sitemap"
+		if *feedDirFlag != "" {
+			for _, lang := range langs {
+				leftToBuilt[filepath.Join(lang, "feed.xml")] = "--feed-dir"
+			}
+		}
+	}
+	if *highlightCSSFlag != "" {
+		leftToBuilt[*highlightCSSFlag] = "--highlight-css"
+	}
+	for outRelPath, source := range leftToBuilt {
+		if outPath := filepath.Join(*outFlag, outRelPath); sources[outPath] == "" {
+			sources[outPath] = source
+		}
+	}
+	// For writeFile, whose side files can't be known until they're written
+	outputSources = sources
+	if *rewriteFlag {
+		links.rewrites = map[string]string{}
+		for from, to := range redirects {
+			// Not the root's to itself with --languages, which only redirects once localized
+			if from != to {
+				links.rewrites[redirectKey(from)] = to
+			}
+		}
+	}
+
+	// For --state, only files that changed since the last build are rebuilt, unless something any
+	// page could depend on changed
+	var state, prevState *buildState
+	incremental := false
+	if *stateFlag != "" {
+		if prevState, err = readState(); err != nil {
+			errLogFunc(err)
+			return
+		}
+		state = &buildState{Files: map[string]stateFile{}}
+		pageHashes := map[string]string{}
+		for i, f := range pageFiles {
+			pageHashes[filepath.ToSlash(f.path)] = fmt.Sprintf("%x", sha256.Sum256(pageContents[i]))
+		}
+		for _, f := range files {
+			hash, ok := pageHashes[filepath.ToSlash(f.path)]
+			if !ok {
+				if hash, err = hashFile(f.path); err != nil {
+					errLogFunc(&IOError{f.path, err})
+					return
+				}
+			}
+			state.Files[f.stateKey()] = stateFile{hash, filepath.ToSlash(filepath.Join(f.lang, f.outRelPath))}
+		}
+		if *searchIndexFlag == "" && *feedDirFlag == "" {
+			pageHashes = nil
+		}
+		if state.Global, err = globalHash(templateFiles, contents, pages, redirects, globals, assets, pageHashes); err != nil {
+			errLogFunc(err)
+			return
+		}
+		incremental = state.Global == prevState.Global
+	}
+
+	// Render the files
+	buildTime = pinnedTime
+	if buildTime.IsZero() {
+		buildTime = time.Now()
+	}
+	templateProfile.reset()
+	searchIndex.reset()
+	feedContent.reset()
+	resetFetches()
+	resetIcons()
+	resetDataFiles()
+	sideFilesMu.Lock()
+	sideFiles = map[string]bool{}
+	sideFilesMu.Unlock()
+	var recorder *RecordingFS
+	baseOutput := Output
+	if incremental {
+		for path, prev := range prevState.Files {
+			if cur, ok := state.Files[path]; !ok || cur.OutPath != prev.OutPath {
+				outPath := filepath.Join(*outFlag, filepath.FromSlash(prev.OutPath))
+				verboseLogger.Printf("Removing output of deleted file: %s", outPath)
+				if err := Output.RemoveAll(outPath); err != nil {
+					errLogFunc(&IOError{outPath, err})
+					return
+				}
+			}
+		}
+	} else {
+		if state != nil {
+			verboseLogger.Printf("Building everything for --state")
+			// Until this build succeeds, the output doesn't match any state
+			if err := os.Remove(*stateFlag); err != nil && !os.IsNotExist(err) {
+				errLogFunc(&IOError{*stateFlag, err})
+				return
+			}
+		}
+		if !*cleanFlag {
+			// Written over in place, then what the last build wrote and this one didn't is removed
+			if _, ok := Output.(OSFS); ok {
+				Output = UnchangedFS{Output}
+			}
+			recorder = NewRecordingFS(Output)
+			Output = recorder
+			defer func() {
+				Output = baseOutput
+			}()
+		} else if _, ok := Output.(OSFS); ok {
+			// Built beside the output dir, which is only replaced if the build succeeds
+			staged, err := NewStagedFS(*outFlag)
+			if err != nil {
+				errLogFunc(&IOError{staged.Staging, err})
+				return
+			}
+			Output = staged
+			defer func() {
+				Output = OSFS{}
+				if atomic.LoadInt32(&failed) > 0 {
+					errLogger.Printf("Keeping the previous output in %s since the build failed", *outFlag)
+				}
+				if err := staged.Discard(); err != nil {
+					errLogFunc(&IOError{staged.Staging, err})
+				}
+			}()
+		} else if err := Output.RemoveAll(*outFlag); err != nil {
+			errLogFunc(&IOError{*outFlag, err})
+			return
+		}
+	}
+	for _, f := range dirs {
+		verboseLogger.Printf("Creating dir: %s", f.outPath)
+		// MkdirAll since writeFile may have created it already
+		if err := Output.MkdirAll(f.outPath, f.info.Mode()); err != nil {
+			errLogFunc(&IOError{f.outPath, err})
+			return
+		}
+	}
+	// Execute the template or copy the file, whichever is appropriate, on --max-open workers in
+	// parallel
+	buildOne := func(f *buildFile) {
+		path, relPath, outRelPath, outPath, info := f.path, f.relPath, f.outRelPath, f.outPath, f.info
+		// The output file, and the input file unless it's a page (read up front)
+		opens := 2
+		if f.page != nil {
+			opens = 1
+		}
+		maxOpenLimit.acquire(opens)
+		if tooManyErrors() {
+			maxOpenLimit.release(opens)
+			return
+		}
+		ok := false
+		defer func() {
+			fileDone(ok, f.page != nil)
+		}()
+		if *prettyURLsFlag && f.page != nil {
+			// The page's own dir isn't in the input dir
+			if err := Output.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+				errLogFunc(&IOError{outPath, err})
+				maxOpenLimit.release(opens)
+				return
+			}
+		}
+		outFile, err := openOutputFile(outPath, info.Mode())
+		defer func() {
+			if outFile != nil {
+				outFile.Close()
+			}
+			maxOpenLimit.release(opens)
+		}()
+		if err != nil {
+			errLogFunc(&IOError{outPath, err})
+			return
+		}
+		if b := banner(path, outPath, buildTime); b != nil {
+			outFile = &bannerWriter{WriteCloser: outFile, banner: b}
+		}
+		if f.page != nil {
+			verboseLogger.Printf("Executing template: %s", path)
+			page, body := f.page.Page, f.body
+			// The output of a preprocessed page (e.g. markdown) is its .Content, not a template
+			var content []byte
+			if f.pre != nil {
+				verboseLogger.Printf("Preprocessing file: %s", path)
+				if content, err = f.pre.transform(path, body); err != nil {
+					errLogFunc(err)
+					return
+				}
+			}
+			var tmpl2 *template.Template
+			layoutName := ""
+			standalone := false
+			var layoutTrees map[string]*parse.Tree
+			layout := page["layout"]
+			if layout == nil && !isHTML(outRelPath) {
+				// Only html goes in a layout, e.g. not a templated feed.xml
+				layout = "none"
+			}
+			switch layout {
+			case "none":
+				standalone = true
+			default:
+				// A template in --templates, or else the section's layout or the base
+				name, ok := layout.(string)
+				if layout != nil && (!ok || tmpl.Lookup(name) == nil) {
+					errLogFunc(fmt.Errorf("%s: unknown layout %v, not none or a template in --templates", path, layout))
+					return
+				}
+				if tmpl2, err = tmpl.Clone(); err != nil {
+					errLogFunc(err)
+					return
+				}
+				withPageFuncs(tmpl2, relPath, outRelPath, f.lang)
+				if layoutName = name; layout == nil {
+					layoutName = sectionLayout(tmpl, relPath)
+				}
+				layoutTrees = templateTrees(tmpl2)
+				if content == nil {
+					if err := parsePage(tmpl2, path, body); err != nil {
+						errLogFunc(&ParseError{path, err})
 						return
 					}
-					tmpl2, err = tmpl2.ParseFiles(path)
-					if err != nil {
-						errLogFunc(err)
-						return
+				}
+				// Without either the page only gets the layout's static parts
+				if !layoutUsesContent && (content != nil || !overridesTemplates(layoutTrees, tmpl2)) {
+					if *baseTemplateOptionalFlag {
+						standalone = true
+					} else {
+						errLogger.Printf("Warning: %s overrides nothing in its layout and the layout doesn't use .Content, so the page will be just the layout (see --base-template-optional)", path)
 					}
-					if err := tmpl2.Execute(outFile, &TemplateData{
-						URL: func(url string) (string, error) {
-							if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
-								return url, nil
-							}
-							fromSlash := filepath.FromSlash(url)
-							stat := fromSlash
-							if filepath.IsAbs(stat) {
-								stat = filepath.Join(*inFlag, stat)
-							} else {
-								return "", errors.New("Relative paths not supported yet") // TODO
-							}
-							if info, err := os.Stat(stat); err != nil {
-								return "", err
-							} else if info.IsDir() {
-								if _, err := os.Stat(filepath.Join(stat, "index.html")); err != nil {
-									return "", err
-								}
-							}
-							return filepath.ToSlash(filepath.Join(rootPath, fromSlash)), nil
-						},
-						Active: func(url string) (bool, error) {
-							if url == "/" {
-								return relPath == "index.html", nil
-							}
-							if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
-								return false, nil
-							}
-							fromSlash := filepath.FromSlash(url)
-							if filepath.IsAbs(fromSlash) {
-								return strings.HasPrefix(relPath, strings.TrimPrefix(fromSlash, string(filepath.Separator))), nil
-							} else {
-								return false, errors.New("Relative paths not supported yet") // TODO
-							}
-						},
-					}); err != nil {
-						errLogFunc(err)
-						return
+				}
+			}
+			if standalone {
+				// Just the page with the funcs
+				verboseLogger.Printf("Rendering standalone: %s", path)
+				tmpl2, layoutName = withPageFuncs(template.New(filepath.Base(path)).Funcs(TemplateFuncs), relPath, outRelPath, f.lang), ""
+				if content != nil {
+					template.Must(tmpl2.Parse("{{.Content}}"))
+				} else if err := parsePage(tmpl2, path, body); err != nil {
+					errLogFunc(&ParseError{path, err})
+					return
+				}
+				// All of it is the page's own
+				layoutTrees = nil
+			}
+			if *strictHTMLEscapingFlag {
+				auditHTML(tmpl2, layoutTrees)
+			}
+			if layoutName == "" {
+				layoutName = tmpl2.Name()
+			}
+			data, err := links.templateData(outRelPath, f.lang)
+			if err != nil {
+				errLogFunc(err)
+				return
+			}
+			data.Page, data.Pages = page, langPages[f.lang]
+			if *dumpContextFlag != "" && filepath.ToSlash(relPath) == filepath.ToSlash(*dumpContextFlag) {
+				b, err := json.MarshalIndent(dumpValue(reflect.ValueOf(data)), "", "  ")
+				if err != nil {
+					errLogFunc(err)
+					return
+				}
+				errLogger.Printf("Context for %s:\n%s", relPath, b)
+			}
+			executeStart := time.Now()
+			if content != nil {
+				data.Content = template.HTML(content)
+			} else if pageName := filepath.Base(path); layoutName != pageName {
+				// Render the page's own content first, for the layout to place as .Content
+				content := bytes.Buffer{}
+				if err := tmpl2.ExecuteTemplate(&content, pageName, data); err != nil {
+					errLogFunc(&ExecuteError{path, err})
+					return
+				}
+				data.Content = template.HTML(content.String())
+			}
+			rendered := bytes.Buffer{}
+			err = tmpl2.ExecuteTemplate(&rendered, layoutName, data)
+			templateProfile.record(layoutName, time.Since(executeStart))
+			if err != nil {
+				errLogFunc(&ExecuteError{path, err})
+				return
+			}
+			out := rendered.Bytes()
+			if *mermaidFlag {
+				out = renderMermaid(path, out)
+			}
+			if *rewriteFlag && isHTML(outRelPath) {
+				// Links written in the html, not through .URL
+				out = links.rewriteLinks(out, f.lang)
+			}
+			if *minifyFlag && isHTML(outRelPath) {
+				out = minifyHTML(out)
+			}
+			if _, err := outFile.Write(out); err != nil {
+				errLogFunc(&IOError{outPath, err})
+				return
+			}
+			if *searchIndexFlag != "" && layout != "none" && page["draft"] != true {
+				searchIndex.add(langURL(f.lang, f.page.URL), page, data.Content, rendered.Bytes())
+			}
+			if *feedDirFlag != "" {
+				feedContent.add(f.page, data.Content)
+			}
+		} else if f.pre != nil {
+			verboseLogger.Printf("Preprocessing file: %s", path)
+			var data, sourceMap []byte
+			err := retry(func() (err error) {
+				data, err = ioutil.ReadFile(path)
+				return err
+			})
+			if err != nil {
+				err = &IOError{path, err}
+			} else if *sourceMapsFlag && f.pre.sourceMap != nil {
+				data, sourceMap, err = f.pre.sourceMap(path, data)
+			} else {
+				data, err = f.pre.transform(path, data)
+			}
+			if err != nil {
+				errLogFunc(err)
+				return
+			}
+			if _, err := outFile.Write(data); err != nil {
+				errLogFunc(&IOError{outPath, err})
+				return
+			}
+			if sourceMap != nil {
+				verboseLogger.Printf("Writing source map: %s.map", outPath)
+				if err := writeOutputFile(outPath+".map", sourceMap, 0644); err != nil {
+					errLogFunc(&IOError{outPath + ".map", err})
+					return
+				}
+			}
+		} else {
+			verboseLogger.Printf("Copying file: %s", path)
+			copied := int64(0)
+			err := retry(func() error {
+				// Pick up where a failed attempt left off
+				inFile, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer inFile.Close()
+				if _, err := inFile.Seek(copied, io.SeekStart); err != nil {
+					return err
+				}
+				n, err := io.Copy(outFile, inFile)
+				copied += n
+				return err
+			})
+			if err != nil {
+				errLogFunc(&IOError{path, err})
+				return
+			}
+		}
+		ok = true
+	}
+	work := make(chan *buildFile)
+	workers := *maxOpenFlag
+	if workers < 1 {
+		workers = 1
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			for f := range work {
+				buildOne(f)
+			}
+		}()
+	}
+	for _, f := range files {
+		if f.skip {
+			fileDone(false, false)
+			continue
+		}
+		if tooManyErrors() {
+			break
+		}
+		if incremental {
+			key := f.stateKey()
+			if prev, ok := prevState.Files[key]; ok && prev.Hash == state.Files[key].Hash {
+				if _, err := Output.Stat(f.outPath); err == nil {
+					continue
+				}
+			}
+		}
+		work <- f
+	}
+	close(work)
+	wg.Wait()
+	if tooManyErrors() {
+		return
+	}
+
+	// Everything else only depends on what the --state global hash covers
+	if !incremental {
+		for _, lang := range langs {
+			for _, taxonomy := range taxonomies {
+				for _, term := range append([]*Term{nil}, terms[lang][taxonomy]...) {
+					// nil for the page listing the terms
+					outRelPath, name := filepath.Join(taxonomy, "index.html"), *termsTemplateFlag
+					if term != nil {
+						outRelPath, name = filepath.FromSlash(strings.TrimPrefix(term.URL, "/")), *taxonomyTemplateFlag
+					}
+					if _, ok := generated[filepath.Join(lang, outRelPath)]; !ok {
+						continue
 					}
-				} else {
-					verboseLogger.Printf("Copying file: %s", path)
-					maxOpenInLimit <- struct{}{}
-					inFile, err := os.Open(path)
-					defer func() {
-						if inFile != nil {
-							inFile.Close()
-						}
-						<-maxOpenInLimit
-					}()
+					data, err := links.templateData(outRelPath, lang)
 					if err != nil {
 						errLogFunc(err)
-						return
+						fileDone(false, true)
+						continue
 					}
-					if _, err := io.Copy(outFile, inFile); err != nil {
+					data.Pages, data.Term, data.Terms = langPages[lang], term, terms[lang][taxonomy]
+					err = renderGenerated(tmpl, layoutUsesContent, outRelPath, name, generated[filepath.Join(lang, outRelPath)], data)
+					if err != nil {
 						errLogFunc(err)
-						return
 					}
+					fileDone(err == nil, true)
 				}
-			}(path, outPath, info)
+			}
 		}
-		return nil
-	}); err != nil {
-		errLogFunc(err)
-		return
 	}
-	wg.Wait()
+
+	if *profileTemplatesFlag {
+		templateProfile.print(reportWriter)
+	}
+	if searchIndexPath != "" && !incremental {
+		if err := searchIndex.write(filepath.Join(*outFlag, searchIndexPath)); err != nil {
+			errLogFunc(&IOError{filepath.Join(*outFlag, searchIndexPath), err})
+		}
+	}
+	if *highlightCSSFlag != "" && !incremental {
+		if err := writeHighlightCSS(*highlightCSSFlag); err != nil {
+			errLogFunc(&IOError{filepath.Join(*outFlag, *highlightCSSFlag), err})
+		}
+	}
+	if !incremental {
+		if baseURL == "" {
+			verboseLogger.Printf("Not writing sitemap, it needs --base-url for absolute URLs")
+		} else if err := writeSitemap(pages, generated); err != nil {
+			errLogFunc(&IOError{filepath.Join(*outFlag, "sitemap.xml"), err})
+		}
+		if *feedDirFlag != "" && baseURL == "" {
+			verboseLogger.Printf("Not writing feed, it needs --base-url for absolute URLs")
+		} else if *feedDirFlag != "" {
+			for _, lang := range langs {
+				if err := feedContent.write(lang, langPages[lang]); err != nil {
+					errLogFunc(&IOError{filepath.Join(*outFlag, lang, "feed.xml"), err})
+				}
+			}
+		}
+	}
+
+	// Redirect pages go last so they can't be clobbered by, or clobber, rendered files
+	if !incremental {
+		for from, to := range redirects {
+			if err := writeRedirect(from, links.localize(to, langs[0])); err != nil {
+				errLogFunc(err)
+			}
+		}
+	}
+
+	if staged, ok := Output.(StagedFS); ok && atomic.LoadInt32(&failed) == 0 {
+		if err := staged.Commit(); err != nil {
+			errLogFunc(&IOError{*outFlag, err})
+		}
+		Output = OSFS{}
+	}
+
+	if recorder != nil {
+		Output = baseOutput
+		if err := updateOutputs(recorder.Names(), atomic.LoadInt32(&failed) == 0); err != nil {
+			errLogFunc(err)
+		}
+	}
+
+	if manifestPath != "" && atomic.LoadInt32(&failed) == 0 {
+		if err := writeManifest(manifestPath); err != nil {
+			errLogFunc(&IOError{filepath.Join(*outFlag, manifestPath), err})
+		}
+	}
+
+	// Only the real filesystem has owners, --diff chowns after copying to it
+	if _, ok := Output.(OSFS); ok {
+		if err := chownOutput(); err != nil {
+			errLogFunc(&IOError{*outFlag, err})
+		}
+	}
+
+	if state != nil && atomic.LoadInt32(&failed) == 0 {
+		if err := state.write(); err != nil {
+			errLogFunc(err)
+		}
+	}
+	return
+}
+
+var redirectTemplate = template.Must(template.New("redirect").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Redirecting to {{.}}</title><link rel="canonical" href="{{.}}"><meta http-equiv="refresh" content="0; url={{.}}"></head>
+<body><a href="{{.}}">{{.}}</a></body></html>
+`))
+
+// outputsFile, in the output dir, lists the files written by the last --clean=false build.
+const outputsFile = ".static-site-outputs"
+
+// updateOutputs records the paths of the files written by this --clean=false build in the
+// outputsFile. If removeStale, files the last build wrote that this one didn't are removed,
+// otherwise they're kept in the list for a later build to remove.
+func updateOutputs(written []string, removeStale bool) error {
+	listPath := filepath.Join(*outFlag, outputsFile)
+	relPaths := map[string]bool{}
+	for _, path := range written {
+		if rel, err := filepath.Rel(*outFlag, path); err == nil && withinDir(*outFlag, path) && rel != outputsFile {
+			relPaths[filepath.ToSlash(rel)] = true
+		}
+	}
+	prev, err := ioutil.ReadFile(listPath)
+	if err != nil && !os.IsNotExist(err) {
+		return &IOError{listPath, err}
+	}
+	for _, rel := range strings.Split(string(prev), "\n") {
+		if rel == "" || relPaths[rel] {
+			continue
+		}
+		if !removeStale {
+			relPaths[rel] = true
+			continue
+		}
+		outPath := filepath.Join(*outFlag, filepath.FromSlash(rel))
+		if !withinDir(*outFlag, outPath) {
+			continue
+		}
+		verboseLogger.Printf("Removing stale output: %s", outPath)
+		if err := Output.RemoveAll(outPath); err != nil {
+			return &IOError{outPath, err}
+		}
+	}
+	list := []string{}
+	for rel := range relPaths {
+		list = append(list, rel+"\n")
+	}
+	sort.Strings(list)
+	if err := writeOutputFile(listPath, []byte(strings.Join(list, "")), 0644); err != nil {
+		return &IOError{listPath, err}
+	}
+	return nil
+}
+
+// parseBuildTime returns the time --build-time, or else the SOURCE_DATE_EPOCH environment
+// variable, pins builds to, or the zero time if neither is set.
+func parseBuildTime() (time.Time, error) {
+	v, name := *buildTimeFlag, "--build-time"
+	if v == "" {
+		v, name = os.Getenv("SOURCE_DATE_EPOCH"), "SOURCE_DATE_EPOCH"
+	}
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be RFC3339 or unix seconds, not %s", name, v)
+	}
+	return t, nil
+}
+
+// readRedirects reads the --redirects file, if any, as a map of old paths to new paths.
+func readRedirects() (map[string]string, error) {
+	redirects := map[string]string{}
+	if *redirectsFlag == "" {
+		return redirects, nil
+	}
+	data, err := ioutil.ReadFile(*redirectsFlag)
+	if err != nil {
+		return nil, &DataError{*redirectsFlag, err}
+	}
+	if err := json.Unmarshal(data, &redirects); err != nil {
+		return nil, &DataError{*redirectsFlag, fmt.Errorf("%s: %v", *redirectsFlag, err)}
+	}
+	for from := range redirects {
+		if !strings.HasPrefix(from, "/") {
+			return nil, &DataError{*redirectsFlag, fmt.Errorf("%s: redirect from %s must be an absolute path", *redirectsFlag, from)}
+		}
+	}
+	return redirects, nil
+}
+
+// readGlobals reads the --globals file, if any, or the files in the --globals dir (see
+// readGlobalsDir).
+func readGlobals() (interface{}, error) {
+	if *globalsFlag == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(*globalsFlag)
+	if err != nil {
+		return nil, &DataError{*globalsFlag, err}
+	}
+	if info.IsDir() {
+		return readGlobalsDir(*globalsFlag)
+	}
+	return readDataFile(*globalsFlag)
+}
+
+// readDataFile reads the file at path as yaml if it ends in .yaml or .yml and json otherwise.
+func readDataFile(path string) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &DataError{path, err}
+	}
+	var v interface{}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, &v)
+	} else {
+		err = json.Unmarshal(data, &v)
+	}
+	if err != nil {
+		return nil, &DataError{path, fmt.Errorf("%s: %v", path, err)}
+	}
+	return v, nil
+}
+
+// isPage reports whether f is executed as a template, and built once per --languages.
+func (f *buildFile) isPage() bool {
+	return hasExt(f.outRelPath, *templateExtFlag) && !f.static && !hasExt(f.path, *rawExtFlag)
+}
+
+// ignored reports whether the path relPath, relative to the input or --static dir, or one of its
+// dirs matches one of the --ignore patterns. Patterns without a / match just the base name.
+func ignored(relPath string) bool {
+	for _, pattern := range strings.Fields(*ignoreFlag) {
+		for p := relPath; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+			name := p
+			if !strings.Contains(pattern, "/") {
+				name = filepath.Base(p)
+			}
+			if ok, _ := filepath.Match(filepath.FromSlash(pattern), name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isHTML reports whether path is an html file, by its extension.
+func isHTML(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".html" || ext == ".htm"
+}
+
+// stateKey identifies f in the --state file, by its path and for pages its language.
+func (f *buildFile) stateKey() string {
+	if f.lang == "" {
+		return filepath.ToSlash(f.path)
+	}
+	return filepath.ToSlash(f.path) + " " + f.lang
+}
+
+// outputPagePath returns where in the output dir the page for the absolute url path lives, an
+// index.html if it names a dir.
+func outputPagePath(url string) string {
+	outPath := filepath.Join(*outFlag, filepath.FromSlash(url))
+	if strings.HasSuffix(url, "/") || filepath.Ext(outPath) == "" {
+		outPath = filepath.Join(outPath, "index.html")
+	}
+	return outPath
+}
+
+// outputWritten reports whether this build has written the file at outPath, which for --clean=false
+// isn't the same as it existing.
+func outputWritten(outPath string) bool {
+	if recorder, ok := Output.(*RecordingFS); ok {
+		return recorder.Wrote(outPath)
+	}
+	_, err := Output.Stat(outPath)
+	return err == nil
+}
+
+// writeRedirect writes a redirect page at the output path for from, pointing at to.
+func writeRedirect(from, to string) error {
+	outPath := outputPagePath(from)
+	if !withinDir(*outFlag, outPath) {
+		return fmt.Errorf("redirect from %s is outside the output dir", from)
+	}
+	if outputWritten(outPath) {
+		return fmt.Errorf("redirect from %s would overwrite %s", from, outPath)
+	}
+	href := to
+	if !strings.HasPrefix(to, "http://") && !strings.HasPrefix(to, "https://") {
+		if !strings.HasPrefix(to, "/") {
+			return fmt.Errorf("redirect to %s must be an absolute path or URL", to)
+		}
+		if _, err := Output.Stat(outputPagePath(to)); err != nil {
+			return fmt.Errorf("redirect from %s to %s: %v", from, to, err)
+		}
+		rel, err := filepath.Rel(filepath.Dir(outPath), filepath.Join(*outFlag, filepath.FromSlash(to)))
+		if err != nil {
+			return err
+		}
+		href = filepath.ToSlash(rel)
+		if strings.HasSuffix(to, "/") {
+			href += "/"
+		}
+	}
+	if err := Output.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(banner("redirect of "+from, outPath, buildTime))
+	if err := redirectTemplate.Execute(buf, href); err != nil {
+		return err
+	}
+	verboseLogger.Printf("Writing redirect: %s -> %s", outPath, href)
+	return writeOutputFile(outPath, buf.Bytes(), 0644)
+}
+
+// openOutputFile creates or truncates the file at name in Output for writing, counting what's
+// written in outputBytes.
+func openOutputFile(name string, perm os.FileMode) (io.WriteCloser, error) {
+	f, err := Output.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{f}, nil
+}
+
+// writeOutputFile is ioutil.WriteFile for Output.
+func writeOutputFile(name string, data []byte, perm os.FileMode) error {
+	f, err := openOutputFile(name, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
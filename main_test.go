@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestFlag sets a flag's value for the rest of the test, restoring it after.
+func setTestFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	prev := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Value.Set(prev)
+	})
+}
+
+// writeFiles writes files, by slash separated path relative to dir, making their dirs.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testSite points the input, output, and templates flags at a new temp dir, with the base
+// template base, returning the input and output dirs.
+func testSite(t *testing.T, base string) (in, out string) {
+	t.Helper()
+	dir := t.TempDir()
+	in, out = filepath.Join(dir, "src"), filepath.Join(dir, "docs")
+	writeFiles(t, dir, map[string]string{"templates/base.html": base})
+	if err := os.MkdirAll(in, 0755); err != nil {
+		t.Fatal(err)
+	}
+	setTestFlag(t, "in", in)
+	setTestFlag(t, "out", out)
+	setTestFlag(t, "templates", filepath.Join(dir, "templates", "base.html"))
+	setTestFlag(t, "data", filepath.Join(dir, "data"))
+	setTestFlag(t, "i18n", filepath.Join(dir, "i18n"))
+	setTestFlag(t, "icons", filepath.Join(dir, "icons"))
+	setTestFlag(t, "fetch-cache", "")
+	return in, out
+}
+
+func TestBuildMaxOpen(t *testing.T) {
+	for _, maxOpen := range []int{1, 2} {
+		t.Run(fmt.Sprintf("max-open %d", maxOpen), func(t *testing.T) {
+			in, out := testSite(t, "<html>{{.Content}}</html>")
+			// Pages hold one file open at a time and copies two
+			files := map[string]string{}
+			for i := 0; i < 300; i++ {
+				dir := fmt.Sprintf("dir%d", i%10)
+				files[fmt.Sprintf("%s/page%d.html", dir, i)] = fmt.Sprintf("<p>page %d</p>", i)
+				files[fmt.Sprintf("%s/file%d.txt", dir, i)] = fmt.Sprintf("file %d", i)
+			}
+			writeFiles(t, in, files)
+			setTestFlag(t, "max-open", fmt.Sprint(maxOpen))
+			prevLimit := maxOpenLimit
+			maxOpenLimit = newFileLimit(maxOpen)
+			defer func() {
+				maxOpenLimit = prevLimit
+			}()
+
+			done := make(chan buildResult)
+			go func() {
+				done <- build()
+			}()
+			var result buildResult
+			select {
+			case result = <-done:
+			case <-time.After(30 * time.Second):
+				t.Fatal("build didn't finish in 30s, deadlocked?")
+			}
+			if result.errs > 0 {
+				t.Fatalf("build failed: %v", result)
+			}
+			if result.pages != 300 || result.copied != 300 {
+				t.Errorf("got %d pages and %d copied files, want 300 of each", result.pages, result.copied)
+			}
+			for name, content := range files {
+				b, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				if strings.HasSuffix(name, ".html") {
+					content = "<html>" + content + "</html>"
+				}
+				if string(b) != content {
+					t.Errorf("%s is %q, want %q", name, b, content)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkParseTemplates reads and parses a base template and 500 partials, reading them one
+// after another or all at once with readFiles as build does.
+func BenchmarkParseTemplates(b *testing.B) {
+	dir := b.TempDir()
+	paths := []string{filepath.Join(dir, "base.html")}
+	if err := ioutil.WriteFile(paths[0], []byte(`<html>{{template "partial0.html" .}}</html>`), 0644); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("partial%d.html", i))
+		text := fmt.Sprintf(`{{define "card%d"}}<div class="card">{{if .Title}}<h2>{{.Title}}</h2>{{end}}{{range .Items}}<p>{{.}}</p>{{end}}</div>{{end}}`, i)
+		if err := ioutil.WriteFile(path, []byte(text+strings.Repeat("<!-- padding -->\n", 200)), 0644); err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	prevLimit := maxOpenLimit
+	maxOpenLimit = newFileLimit(100)
+	defer func() {
+		maxOpenLimit = prevLimit
+	}()
+
+	reads := map[string]func([]string) ([][]byte, error){
+		"serial": func(paths []string) ([][]byte, error) {
+			contents := make([][]byte, len(paths))
+			for i, path := range paths {
+				var err error
+				if contents[i], err = ioutil.ReadFile(path); err != nil {
+					return nil, err
+				}
+			}
+			return contents, nil
+		},
+		"concurrent": readFiles,
+	}
+	for _, name := range []string{"serial", "concurrent"} {
+		read := reads[name]
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				contents, err := read(paths)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := parseTemplates(paths, contents); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	tests := []struct {
+		url, page string
+		want      bool
+	}{
+		{"/blog/index.html", "blog/index.html", true},
+		{"/blog/index.html", "blog/post.html", true},
+		{"/blog/index.html", "blog/sub/x.html", true},
+		{"/blog/index.html", "blogroll.html", false},
+		{"/blog/index.html", "index.html", false},
+		{"/blog/", "blog/post.html", true},
+		{"/blog/", "blog/sub/x.html", true},
+		{"/blog/", "blogroll.html", false},
+		{"../index.html", "blog/sub/x.html", true},
+		{"index.html", "blog/post.html", true},
+		{"/index.html", "index.html", true},
+		{"/index.html", "blog/index.html", false},
+		{"/index.html", "blog/post.html", false},
+		{"/index.html", "blogroll.html", false},
+		{"/", "index.html", true},
+		{"/", "blogroll.html", false},
+		{"/", "blog/index.html", false},
+	}
+	for _, indexDirURLs := range []string{"false", "true"} {
+		t.Run("index-dir-urls "+indexDirURLs, func(t *testing.T) {
+			setTestFlag(t, "index-dir-urls", indexDirURLs)
+			s := &site{redirects: map[string]string{}, preprocessed: map[string]string{}, generated: map[string]bool{}, pages: map[string]bool{}, pretty: map[string]string{}}
+			for _, test := range tests {
+				data, err := s.templateData(filepath.FromSlash(test.page), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err := data.Active(test.url); err != nil || got != test.want {
+					t.Errorf("Active(%q) in %s = %v, %v, want %v", test.url, test.page, got, err, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	s := &site{rewrites: map[string]string{}}
+	for from, to := range map[string]string{"/old/": "/new/", "/old.html": "/new.html", "/gone/index.html": "https://example.com/gone"} {
+		s.rewrites[redirectKey(from)] = to
+	}
+	tests := []struct{ link, want string }{
+		{"/old", "/new/"},
+		{"/old/", "/new/"},
+		{"/old/index.html", "/new/"},
+		{"/old/#frag", "/new/#frag"},
+		{"/old?x=1", "/new/?x=1"},
+		{"/old/?x=1&y=2#frag", "/new/?x=1&y=2#frag"},
+		{"/./old//", "/new/"},
+		{"/old.html#top", "/new.html#top"},
+		{"/gone/", "https://example.com/gone"},
+		{"/older/", "/older/"},
+		{"old/", "old/"},
+		{"https://example.com/old/", "https://example.com/old/"},
+		{"#old", "#old"},
+	}
+	for _, test := range tests {
+		if got := s.rewriteURL(test.link, ""); got != test.want {
+			t.Errorf("rewriteURL(%q) = %q, want %q", test.link, got, test.want)
+		}
+	}
+	out := s.rewriteLinks([]byte(`<a href="/old/#frag">a</a> <img src='/old.html'> <a href="/other/">b</a> <p>href="/old/"</p>`), "")
+	want := `<a href="/new/#frag">a</a> <img src='/new.html'> <a href="/other/">b</a> <p>href="/old/"</p>`
+	if string(out) != want {
+		t.Errorf("rewriteLinks = %s, want %s", out, want)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	tmpl := template.Must(template.New("page.html").Funcs(TemplateFuncs).Parse(`{{define "card"}}<b>{{.}}</b>{{end}}{{include "card" .Item}} {{partial "card" .Item}}`))
+	withPageFuncs(tmpl, "page.html", "page.html", "")
+	b := strings.Builder{}
+	if err := tmpl.Execute(&b, map[string]string{"Item": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<b>x</b> <b>x</b>"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+
+	tmpl = template.Must(template.New("page.html").Funcs(TemplateFuncs).Parse(`{{include "missing" .}}`))
+	withPageFuncs(tmpl, "page.html", "page.html", "")
+	if err := tmpl.Execute(&b, nil); err == nil || !strings.Contains(err.Error(), `no template "missing"`) {
+		t.Errorf("got error %v, want one for the missing template", err)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	setTestFlag(t, "banner", "true")
+	setTestFlag(t, "banner-ext", ".html .css")
+	setTestFlag(t, "banner-text", "from {source}")
+	now := time.Unix(0, 0)
+	tests := []struct{ source, outPath, want string }{
+		{"src/post.md", "docs/post.html", "<!-- from src/post.md -->\n"},
+		{"src/style.scss", "docs/style.css", "/* from src/style.scss */\n"},
+		{"src/page.html", "docs/page.html", "<!-- from src/page.html -->\n"},
+		{"src/app.js", "docs/app.js", ""},
+		{"src/notes.md", "docs/notes.txt", ""},
+	}
+	for _, test := range tests {
+		if got := string(banner(filepath.FromSlash(test.source), filepath.FromSlash(test.outPath), now)); got != test.want {
+			t.Errorf("banner(%q, %q) = %q, want %q", test.source, test.outPath, got, test.want)
+		}
+	}
+}
+
+func TestPreprocessedContent(t *testing.T) {
+	in, out := testSite(t, "<html>{{.Content}}</html>")
+	prev, ok := Preprocessors[".md"]
+	Preprocessors[".md"] = preprocessor{".html", func(path string, b []byte) ([]byte, error) {
+		return []byte("<p>" + strings.TrimSpace(string(b)) + "</p>"), nil
+	}, nil, false}
+	defer func() {
+		if ok {
+			Preprocessors[".md"] = prev
+		} else {
+			delete(Preprocessors, ".md")
+		}
+	}()
+	writeFiles(t, in, map[string]string{
+		"post.md": "Use {{.Title}} and {{template \"x\"}} as is",
+		"raw.md":  "---\nlayout: none\n---\nNo {{layout}}",
+	})
+	if result := build(); result.errs > 0 {
+		t.Fatalf("build failed: %v", result)
+	}
+	for name, want := range map[string]string{
+		"post.html": `<html><p>Use {{.Title}} and {{template "x"}} as is</p></html>`,
+		"raw.html":  `<p>No {{layout}}</p>`,
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s is %q, want %q", name, b, want)
+		}
+	}
+}
+
+func TestSitemapGenerated(t *testing.T) {
+	prevBaseURL := baseURL
+	baseURL = "https://example.com"
+	defer func() {
+		baseURL = prevBaseURL
+	}()
+	generated := map[string]string{filepath.Join("tags", "index.html"): "taxonomy tags", filepath.Join("tags", "go", "index.html"): "taxonomy tags term go"}
+	for _, flags := range [][]string{{"index-dir-urls"}, {"pretty-urls"}, {"index-dir-urls", "pretty-urls"}} {
+		t.Run(strings.Join(flags, " "), func(t *testing.T) {
+			_, out := testSite(t, "")
+			for _, name := range flags {
+				setTestFlag(t, name, "true")
+			}
+			if err := os.MkdirAll(out, 0755); err != nil {
+				t.Fatal(err)
+			}
+			pages := []*PageInfo{newPageInfo("about.html", "about.html", "", nil), newPageInfo("404.html", "404.html", "", nil)}
+			if err := writeSitemap(pages, generated); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(out, "sitemap.xml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, loc := range []string{"https://example.com/about.html", "https://example.com/tags/", "https://example.com/tags/go/"} {
+				if !strings.Contains(string(b), "<loc>"+loc+"</loc>") {
+					t.Errorf("sitemap has no %s:\n%s", loc, b)
+				}
+			}
+			if strings.Contains(string(b), "404.html") {
+				t.Errorf("sitemap has the 404 page:\n%s", b)
+			}
+		})
+	}
+}
+
+func TestBannerGenerated(t *testing.T) {
+	in, out := testSite(t, `<html>{{.Content}}</html>{{define "taxonomy"}}{{.Term.Name}}{{end}}{{define "terms"}}terms{{end}}`)
+	writeFiles(t, in, map[string]string{"post.html": "---\ntags: go\n---\npost", "new.html": "new"})
+	redirects := filepath.Join(filepath.Dir(in), "redirects.json")
+	writeFiles(t, filepath.Dir(in), map[string]string{"redirects.json": `{"/old.html": "/new.html"}`})
+	setTestFlag(t, "taxonomies", "tags")
+	setTestFlag(t, "redirects", redirects)
+	setTestFlag(t, "banner", "true")
+	setTestFlag(t, "banner-text", "from {source}")
+	if result := build(); result.errs > 0 {
+		t.Fatalf("build failed: %v", result)
+	}
+	for name, want := range map[string]string{
+		"post.html":          "<!-- from " + filepath.ToSlash(filepath.Join(in, "post.html")) + " -->\n",
+		"tags/index.html":    "<!-- from taxonomy tags -->\n",
+		"tags/go/index.html": "<!-- from taxonomy tags term go -->\n",
+		"old.html":           "<!-- from redirect of /old.html -->\n",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(b), want) {
+			t.Errorf("%s doesn't start with %q:\n%s", name, want, b)
+		}
+	}
+}
+
+func TestWrittenAfterCollision(t *testing.T) {
+	for _, name := range []string{"manifest", "search-index"} {
+		t.Run(name, func(t *testing.T) {
+			in, out := testSite(t, "<html>{{.Content}}</html>")
+			writeFiles(t, in, map[string]string{"index.html": "home", "app.json": `{"name": "app"}`})
+			setTestFlag(t, name, "app.json")
+			if result := build(); result.errs != 1 {
+				t.Errorf("got %d errors, want 1 for app.json: %v", result.errs, result)
+			}
+			setTestFlag(t, name, "other.json")
+			if result := build(); result.errs > 0 {
+				t.Fatalf("build failed: %v", result)
+			}
+			if b, err := ioutil.ReadFile(filepath.Join(out, "app.json")); err != nil || string(b) != `{"name": "app"}` {
+				t.Errorf("app.json is %q, %v, want the input's", b, err)
+			}
+		})
+	}
+}
+
+func TestInsertBanner(t *testing.T) {
+	b := "<!-- b -->\n"
+	tests := []struct{ content, want string }{
+		{"<html></html>", b + "<html></html>"},
+		{"", b},
+		{`<?xml version="1.0"?>` + "\n<svg/>", `<?xml version="1.0"?>` + "\n" + b + "<svg/>"},
+		{`<?xml version="1.0"?><svg/>`, `<?xml version="1.0"?>` + b + "<svg/>"},
+		{"\xef\xbb\xbf<svg/>", "\xef\xbb\xbf" + b + "<svg/>"},
+		{`@charset "utf-8";` + "\nbody {}", `@charset "utf-8";` + "\n" + b + "body {}"},
+		{"<?xm", b + "<?xm"},
+		{"<?xml never closed", b + "<?xml never closed"},
+	}
+	for _, test := range tests {
+		if got := string(insertBanner([]byte(b), []byte(test.content))); got != test.want {
+			t.Errorf("insertBanner(%q) = %q, want %q", test.content, got, test.want)
+		}
+		// The same a byte at a time through a bannerWriter
+		out := &closeBuffer{}
+		w := &bannerWriter{WriteCloser: out, banner: []byte(b)}
+		for i := 0; i < len(test.content); i++ {
+			if _, err := w.Write([]byte(test.content[i : i+1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.String(); got != test.want || !out.closed {
+			t.Errorf("bannerWriter of %q wrote %q, closed %v, want %q", test.content, got, out.closed, test.want)
+		}
+	}
+}
+
+// closeBuffer is a bytes.Buffer that records being closed.
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestScssPartials(t *testing.T) {
+	in, _ := testSite(t, "<html>{{.Content}}</html>")
+	writeFiles(t, in, map[string]string{"style.scss": `@use "vars";`, "_vars.scss": "$c: red;"})
+	prevPath := os.Getenv("PATH")
+	os.Setenv("PATH", t.TempDir())
+	defer os.Setenv("PATH", prevPath)
+	if err := lookSass("style.scss"); err == nil || !strings.Contains(err.Error(), "install sass or use --preprocess .scss=") {
+		t.Errorf("got error %v, want one saying to install sass", err)
+	}
+	// Only the error for style.scss, the partial is neither built nor copied
+	if result := build(); result.errs != 1 || result.failed != 1 || result.copied != 0 {
+		t.Errorf("got %d errors, %d failed, and %d copied files, want 1, 1, and 0: %v", result.errs, result.failed, result.copied, result)
+	}
+}
+
+func TestSearchIndexPrettyURLs(t *testing.T) {
+	in, out := testSite(t, "<html>{{.Content}}</html>")
+	writeFiles(t, in, map[string]string{"index.html": "home", "about.html": "about", "blog/index.html": "blog"})
+	setTestFlag(t, "pretty-urls", "true")
+	setTestFlag(t, "search-index", "search.json")
+	if result := build(); result.errs > 0 {
+		t.Fatalf("build failed: %v", result)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(out, "search.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []searchEntry{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{}
+	for _, entry := range entries {
+		urls = append(urls, entry.URL)
+	}
+	if got, want := strings.Join(urls, " "), "/ /about/ /blog/"; got != want {
+		t.Errorf("got URLs %s, want %s", got, want)
+	}
+}
+
+func TestWriteFileCollision(t *testing.T) {
+	in, out := testSite(t, "<html>{{.Content}}</html>")
+	writeFiles(t, in, map[string]string{"index.html": `{{writeFile "style.css" "side"}}`, "style.css": "body {}"})
+	if result := build(); result.errs != 1 {
+		t.Fatalf("got %d errors, want 1 for style.css: %v", result.errs, result)
+	}
+	// The rest builds once the side file is elsewhere
+	writeFiles(t, in, map[string]string{"index.html": `{{writeFile "side.css" "side"}}`})
+	if result := build(); result.errs > 0 {
+		t.Fatalf("build failed: %v", result)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(out, "style.css")); err != nil || string(b) != "body {}" {
+		t.Errorf("style.css is %q, %v, want the copied file", b, err)
+	}
+}
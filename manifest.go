@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// manifestEntry is a file in the --manifest.
+type manifestEntry struct {
+	Path   string `json:"path"` // Relative to the output dir, slash separated
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// writeManifest writes the json --manifest at the output-relative outRelPath, listing every file
+// in the output dir as it is after the build (whichever files this build left alone included)
+// with its size and sha256, sorted by path. The manifest itself and the outputsFile aren't listed.
+func writeManifest(outRelPath string) error {
+	outPath := filepath.Join(*outFlag, outRelPath)
+	entries := []manifestEntry{}
+	add := func(path string, size int64, hash string) {
+		rel, err := filepath.Rel(*outFlag, path)
+		if err != nil || filepath.Clean(path) == filepath.Clean(outPath) || rel == outputsFile {
+			return
+		}
+		entries = append(entries, manifestEntry{filepath.ToSlash(rel), size, hash})
+	}
+	if mem, ok := Output.(*MemFS); ok {
+		// --diff, with nothing on disk yet
+		for _, name := range mem.Files() {
+			data, err := mem.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			add(name, int64(len(data)), fmt.Sprintf("%x", sha256.Sum256(data)))
+		}
+	} else if err := filepath.Walk(*outFlag, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		hash, err := hashFile(path)
+		add(path, info.Size(), hash)
+		return err
+	}); err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	b, err := marshalOutputJSON(entries)
+	if err != nil {
+		return err
+	}
+	if err := Output.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+	verboseLogger.Printf("Writing manifest: %s", outPath)
+	return writeOutputFile(outPath, b, 0644)
+}
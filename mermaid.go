@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// mermaidRegexp matches mermaid diagrams, as markdown renders ```mermaid fences or as the mermaid
+// runtime expects them in html.
+var mermaidRegexp = regexp.MustCompile(`(?s)<pre><code class="language-mermaid">(.*?)</code></pre>|<pre class="mermaid">(.*?)</pre>`)
+
+// mermaidSVGs remembers the svg of each diagram source rendered so far.
+var mermaidSVGs = struct {
+	mu   sync.Mutex
+	svgs map[string][]byte
+}{svgs: map[string][]byte{}}
+
+// renderMermaid returns page, the output of the page at path, with its mermaid diagrams replaced
+// by inline svg from --mermaid-command. Diagrams that fail to render are left as they are, with a
+// warning.
+func renderMermaid(path string, page []byte) []byte {
+	return mermaidRegexp.ReplaceAllFunc(page, func(block []byte) []byte {
+		m := mermaidRegexp.FindSubmatch(block)
+		source := html.UnescapeString(string(m[1]) + string(m[2]))
+		svg, err := mermaidSVG(source)
+		if err != nil {
+			errLogger.Printf("Warning: leaving a mermaid diagram in %s as is: %v", path, err)
+			return block
+		}
+		return svg
+	})
+}
+
+// mermaidSVG renders the diagram source with --mermaid-command.
+func mermaidSVG(source string) ([]byte, error) {
+	mermaidSVGs.mu.Lock()
+	svg, ok := mermaidSVGs.svgs[source]
+	mermaidSVGs.mu.Unlock()
+	if ok {
+		return svg, nil
+	}
+	dir, err := ioutil.TempDir("", "mermaid")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input, output := filepath.Join(dir, "diagram.mmd"), filepath.Join(dir, "diagram.svg")
+	if err := ioutil.WriteFile(input, []byte(source), 0644); err != nil {
+		return nil, err
+	}
+	command := strings.NewReplacer("{{input}}", shellQuote(input), "{{output}}", shellQuote(output)).Replace(*mermaidCommandFlag)
+	if out, err := exec.Command("sh", "-c", command).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", *mermaidCommandFlag, err, bytes.TrimSpace(out))
+	}
+	if svg, err = ioutil.ReadFile(output); err != nil {
+		return nil, err
+	}
+	// Inline, so without any xml declaration
+	if i := bytes.Index(svg, []byte("<svg")); i > 0 {
+		svg = svg[i:]
+	}
+	mermaidSVGs.mu.Lock()
+	mermaidSVGs.svgs[source] = svg
+	mermaidSVGs.mu.Unlock()
+	return svg, nil
+}
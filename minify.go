@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+)
+
+// rawTextElements keep their content as is when minifying, whitespace being significant in pre
+// and textarea, and script and style not being html.
+var rawTextElements = map[string]bool{"pre": true, "textarea": true, "script": true, "style": true}
+
+// minifyHTML returns the html page in with the whitespace between and around tags collapsed to a
+// single space and comments, other than conditional comments, removed. Tags and the content of
+// rawTextElements are left as they are.
+func minifyHTML(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); {
+		switch {
+		case bytes.HasPrefix(in[i:], []byte("<!--")):
+			end := bytes.Index(in[i+4:], []byte("-->"))
+			if end < 0 {
+				return append(out, in[i:]...)
+			}
+			end += i + 4 + len("-->")
+			if bytes.HasPrefix(in[i+4:], []byte("[if")) || bytes.HasPrefix(in[i+4:], []byte("<![endif")) {
+				out = append(out, in[i:end]...)
+			}
+			i = end
+		case in[i] == '<' && i+1 < len(in) && (isLetter(in[i+1]) || in[i+1] == '/' || in[i+1] == '!'):
+			end := tagEnd(in, i)
+			name := bytes.ToLower(in[i+1 : i+1+nameLen(in[i+1:end])])
+			out = append(out, in[i:end]...)
+			i = end
+			if rawTextElements[string(name)] {
+				close := bytes.Index(bytes.ToLower(in[i:]), append([]byte("</"), name...))
+				if close < 0 {
+					return append(out, in[i:]...)
+				}
+				out = append(out, in[i:i+close]...)
+				i += close
+			}
+		case isSpace(in[i]):
+			for i < len(in) && isSpace(in[i]) {
+				i++
+			}
+			if len(out) > 0 && out[len(out)-1] != ' ' {
+				out = append(out, ' ')
+			}
+		default:
+			out = append(out, in[i])
+			i++
+		}
+	}
+	return bytes.TrimSpace(out)
+}
+
+// tagEnd returns the index just past the end of the tag starting at in[start], skipping any > in
+// quoted attribute values.
+func tagEnd(in []byte, start int) int {
+	var quote byte
+	for i := start + 1; i < len(in); i++ {
+		switch {
+		case quote != 0:
+			if in[i] == quote {
+				quote = 0
+			}
+		case in[i] == '"' || in[i] == '\'':
+			quote = in[i]
+		case in[i] == '>':
+			return i + 1
+		}
+	}
+	return len(in)
+}
+
+// nameLen returns the length of the tag name at the start of b.
+func nameLen(b []byte) int {
+	n := 0
+	for n < len(b) && (isLetter(b[n]) || (n > 0 && b[n] >= '0' && b[n] <= '9')) {
+		n++
+	}
+	return n
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputFS is everything build does to the output dir, so it can target something other than
+// the real filesystem.
+type OutputFS interface {
+	MkdirAll(path string, perm os.FileMode) error
+	OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error)
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+}
+
+// Output is where build writes to, the OS filesystem unless replaced (e.g. with a MemFS in tests).
+var Output OutputFS = OSFS{}
+
+// OSFS is an OutputFS backed by the os package.
+type OSFS struct{}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// OpenFile truncating a file writes a temp file beside it instead, renamed over it with perm when
+// closed, so it's never seen half written. If a write fails the temp file is removed on close,
+// leaving the file as it was.
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	if flag&os.O_TRUNC == 0 || flag&os.O_EXCL != 0 {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			// Not a nil *os.File in a non-nil interface
+			return nil, err
+		}
+		return f, nil
+	}
+	if flag&os.O_CREATE == 0 {
+		if _, err := os.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, name: name, perm: perm}, nil
+}
+
+// atomicFile is a temp file renamed to name when closed, see OSFS.OpenFile.
+type atomicFile struct {
+	*os.File
+	name string
+	perm os.FileMode
+	err  error
+}
+
+func (f *atomicFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *atomicFile) Close() error {
+	err := f.File.Close()
+	if err == nil && f.err == nil {
+		if err = os.Chmod(f.File.Name(), f.perm); err == nil {
+			err = os.Rename(f.File.Name(), f.name)
+		}
+	}
+	if err != nil || f.err != nil {
+		os.Remove(f.File.Name())
+	}
+	return err
+}
+
+func (OSFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// UnchangedFS is an OutputFS that leaves the files on disk alone whose new content, written
+// truncating them, turns out to be the same, for --clean=false. The content is compared as it's
+// written, so only what differs is held back, and nothing is if a file is new.
+type UnchangedFS struct {
+	OutputFS
+}
+
+func (fs UnchangedFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	if flag&os.O_TRUNC == 0 || flag&os.O_EXCL != 0 {
+		return fs.OutputFS.OpenFile(name, flag, perm)
+	}
+	existing, err := os.Open(name)
+	if err != nil {
+		return fs.OutputFS.OpenFile(name, flag, perm)
+	}
+	return &unchangedFile{fs: fs.OutputFS, name: name, flag: flag, perm: perm, existing: existing}, nil
+}
+
+// unchangedFile compares what's written with the existing file, only opening the file for real
+// when they differ, with the part that matched copied over first.
+type unchangedFile struct {
+	fs       OutputFS
+	name     string
+	flag     int
+	perm     os.FileMode
+	existing *os.File
+	matched  int64
+	out      io.WriteCloser
+}
+
+func (f *unchangedFile) Write(p []byte) (int, error) {
+	if f.out == nil {
+		buf := make([]byte, len(p))
+		n, _ := io.ReadFull(f.existing, buf)
+		if n == len(p) && bytes.Equal(buf, p) {
+			f.matched += int64(n)
+			return n, nil
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	return f.out.Write(p)
+}
+
+// open opens the file and writes the part of the existing one matched so far to it.
+func (f *unchangedFile) open() error {
+	out, err := f.fs.OpenFile(f.name, f.flag, f.perm)
+	if err != nil {
+		return err
+	}
+	f.out = out
+	if _, err := f.existing.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(f.out, f.existing, f.matched)
+	return err
+}
+
+func (f *unchangedFile) Close() error {
+	defer f.existing.Close()
+	if f.out == nil {
+		if n, _ := f.existing.Read(make([]byte, 1)); n == 0 {
+			verboseLogger.Printf("Unchanged: %s", f.name)
+			return nil
+		}
+		// The new content is shorter
+		if err := f.open(); err != nil {
+			if f.out != nil {
+				f.out.Close()
+			}
+			return err
+		}
+	}
+	return f.out.Close()
+}
+
+// StagedFS is an OSFS that writes what's meant for Dir to the Staging dir beside it instead, for
+// Commit to move into place, so a failed build can leave Dir as it was.
+type StagedFS struct {
+	Dir     string
+	Staging string
+}
+
+// NewStagedFS returns a StagedFS for dir, staging in a hidden dir beside it, emptied and ready.
+func NewStagedFS(dir string) (StagedFS, error) {
+	fs := StagedFS{dir, filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".staging")}
+	if err := os.RemoveAll(fs.Staging); err != nil {
+		return fs, err
+	}
+	return fs, os.MkdirAll(fs.Staging, 0755)
+}
+
+// path returns where name is written, in Staging if it's in Dir.
+func (fs StagedFS) path(name string) string {
+	if !withinDir(fs.Dir, name) {
+		return name
+	}
+	rel, err := filepath.Rel(fs.Dir, name)
+	if err != nil {
+		return name
+	}
+	return filepath.Join(fs.Staging, rel)
+}
+
+func (fs StagedFS) MkdirAll(path string, perm os.FileMode) error {
+	return OSFS{}.MkdirAll(fs.path(path), perm)
+}
+
+func (fs StagedFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	return OSFS{}.OpenFile(fs.path(name), flag, perm)
+}
+
+func (fs StagedFS) RemoveAll(path string) error {
+	return OSFS{}.RemoveAll(fs.path(path))
+}
+
+func (fs StagedFS) Rename(oldpath, newpath string) error {
+	return OSFS{}.Rename(fs.path(oldpath), fs.path(newpath))
+}
+
+func (fs StagedFS) Stat(name string) (os.FileInfo, error) {
+	return OSFS{}.Stat(fs.path(name))
+}
+
+// Commit replaces Dir with Staging.
+func (fs StagedFS) Commit() error {
+	old := fs.Staging + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(fs.Dir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(fs.Staging, fs.Dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// Discard removes Staging, if Commit hasn't moved it.
+func (fs StagedFS) Discard() error {
+	return os.RemoveAll(fs.Staging)
+}
+
+// RecordingFS is an OutputFS that records the files written to it, for --clean=false.
+type RecordingFS struct {
+	OutputFS
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func NewRecordingFS(fs OutputFS) *RecordingFS {
+	return &RecordingFS{OutputFS: fs, names: map[string]bool{}}
+}
+
+func (fs *RecordingFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	fs.record(name)
+	return fs.OutputFS.OpenFile(name, flag, perm)
+}
+
+func (fs *RecordingFS) Rename(oldpath, newpath string) error {
+	fs.record(newpath)
+	return fs.OutputFS.Rename(oldpath, newpath)
+}
+
+func (fs *RecordingFS) record(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.names[filepath.Clean(name)] = true
+}
+
+// Wrote reports whether the file at name was written.
+func (fs *RecordingFS) Wrote(name string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.names[filepath.Clean(name)]
+}
+
+// Names returns the sorted paths of the files written.
+func (fs *RecordingFS) Names() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	names := []string{}
+	for name := range fs.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MemFS is an in-memory OutputFS, safe for concurrent use. Written files become visible when they
+// are closed.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: map[string]*memFile{}}
+}
+
+// ReadFile returns the contents of the file at name.
+func (fs *MemFS) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[filepath.Clean(name)]
+	if !ok || f.mode.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+// Files returns the sorted paths of all files (not dirs).
+func (fs *MemFS) Files() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	names := []string{}
+	for name, f := range fs.files {
+		if !f.mode.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CopyTo writes everything in fs to dst, dirs before the files in them.
+func (fs *MemFS) CopyTo(dst OutputFS) error {
+	fs.mu.Lock()
+	files := []*memFile{}
+	for _, f := range fs.files {
+		files = append(files, f)
+	}
+	fs.mu.Unlock()
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	for _, f := range files {
+		if f.mode.IsDir() {
+			if err := dst.MkdirAll(f.name, f.mode.Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := dst.MkdirAll(filepath.Dir(f.name), 0755); err != nil {
+			return err
+		}
+		w, err := dst.OpenFile(f.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(f.data); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for dir := filepath.Clean(path); !fs.isRoot(dir); dir = filepath.Dir(dir) {
+		if f, ok := fs.files[dir]; ok {
+			if !f.mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+			}
+			break
+		}
+		fs.files[dir] = &memFile{name: dir, mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+	}
+	return nil
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if dir := filepath.Dir(name); !fs.isRoot(dir) {
+		if f, ok := fs.files[dir]; !ok || !f.mode.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+	}
+	w := &memWriter{fs: fs, file: memFile{name: name, mode: perm.Perm()}}
+	if f, ok := fs.files[name]; ok {
+		if f.mode.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if flag&os.O_TRUNC == 0 {
+			w.buf.Write(f.data)
+		}
+		w.file.mode = f.mode
+	} else if flag&os.O_CREATE == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return w, nil
+}
+
+func (fs *MemFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for name := range fs.files {
+		if withinDir(path, name) {
+			delete(fs.files, name)
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[oldpath]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	for name := range fs.files {
+		if withinDir(newpath, name) {
+			delete(fs.files, name)
+		}
+	}
+	moved := []*memFile{}
+	for name, f := range fs.files {
+		if withinDir(oldpath, name) {
+			delete(fs.files, name)
+			f.name = newpath + strings.TrimPrefix(name, oldpath)
+			moved = append(moved, f)
+		}
+	}
+	for _, f := range moved {
+		fs.files[f.name] = f
+	}
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.isRoot(name) {
+		return memFileInfo{name: name, mode: os.ModeDir | 0755}, nil
+	}
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memFileInfo{name: f.name, size: int64(len(f.data)), mode: f.mode, modTime: f.modTime}, nil
+}
+
+func (fs *MemFS) isRoot(dir string) bool {
+	return dir == "." || dir == string(filepath.Separator)
+}
+
+type memWriter struct {
+	fs   *MemFS
+	file memFile
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	w.file.data = w.buf.Bytes()
+	w.file.modTime = time.Now()
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.fs.files[w.file.name] = &w.file
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi memFileInfo) Name() string       { return filepath.Base(fi.name) }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// TarFS is an OutputFS that streams everything written to it as a tar archive, for --out -. Files
+// are buffered until closed, then written whole. Close must be called to finish the archive.
+type TarFS struct {
+	ModTime time.Time // Of every entry, when it's written if zero
+	root    string
+	mu      sync.Mutex
+	tw      *tar.Writer
+	entries map[string]memFileInfo
+}
+
+// NewTarFS returns a TarFS writing to w, with entries named relative to root.
+func NewTarFS(w io.Writer, root string) *TarFS {
+	return &TarFS{root: root, tw: tar.NewWriter(w), entries: map[string]memFileInfo{}}
+}
+
+// modTime returns the time to give an entry written now.
+func (fs *TarFS) modTime() time.Time {
+	if fs.ModTime.IsZero() {
+		return time.Now()
+	}
+	return fs.ModTime
+}
+
+func (fs *TarFS) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.tw.Close()
+}
+
+// entryName returns the archive name of path, or "" for the root.
+func (fs *TarFS) entryName(path string) (string, error) {
+	rel, err := filepath.Rel(fs.root, path)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(fs.root, path) {
+		return "", fmt.Errorf("%s is outside %s", path, fs.root)
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (fs *TarFS) MkdirAll(path string, perm os.FileMode) error {
+	name, err := fs.entryName(path)
+	if err != nil || name == "" {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mkdirAll(name, perm)
+}
+
+func (fs *TarFS) mkdirAll(name string, perm os.FileMode) error {
+	if info, ok := fs.entries[name]; ok {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+		}
+		return nil
+	}
+	if parent := path.Dir(name); parent != "." {
+		if err := fs.mkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	info := memFileInfo{name: name, mode: os.ModeDir | perm.Perm(), modTime: fs.modTime()}
+	if err := fs.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     int64(info.mode.Perm()),
+		ModTime:  info.modTime,
+	}); err != nil {
+		return err
+	}
+	fs.entries[name] = info
+	return nil
+}
+
+func (fs *TarFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	entry, err := fs.entryName(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.entries[entry]; ok {
+		// Entries can't be rewritten once streamed
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	return &tarWriter{fs: fs, name: entry, mode: perm.Perm()}, nil
+}
+
+// RemoveAll does nothing, there's nothing to remove from a fresh archive.
+func (fs *TarFS) RemoveAll(path string) error {
+	return nil
+}
+
+func (fs *TarFS) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("can't rename within a tar stream")}
+}
+
+func (fs *TarFS) Stat(name string) (os.FileInfo, error) {
+	entry, err := fs.entryName(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == "" {
+		return memFileInfo{name: fs.root, mode: os.ModeDir | 0755}, nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, ok := fs.entries[entry]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return info, nil
+}
+
+type tarWriter struct {
+	fs   *TarFS
+	name string
+	mode os.FileMode
+	buf  bytes.Buffer
+}
+
+func (w *tarWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *tarWriter) Close() error {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	if _, ok := w.fs.entries[w.name]; ok {
+		return &os.PathError{Op: "close", Path: w.name, Err: os.ErrExist}
+	}
+	info := memFileInfo{name: w.name, size: int64(w.buf.Len()), mode: w.mode, modTime: w.fs.modTime()}
+	if err := w.fs.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     w.name,
+		Mode:     int64(info.mode),
+		Size:     info.size,
+		ModTime:  info.modTime,
+	}); err != nil {
+		return err
+	}
+	if _, err := w.fs.tw.Write(w.buf.Bytes()); err != nil {
+		return err
+	}
+	w.fs.entries[w.name] = info
+	return nil
+}
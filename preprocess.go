@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// preprocessor turns a source file into the content of an output file with extension ext. If ext
+// is .html, the output is a page, placed as is (not executed) as .Content of its layout.
+type preprocessor struct {
+	ext       string
+	transform func(path string, data []byte) ([]byte, error)
+	// For --source-maps, if it can make one, like transform but also returning the source map for
+	// the output, which it expects to be written next to it as outname.map
+	sourceMap func(path string, data []byte) ([]byte, []byte, error)
+	// Whether files named starting with _ are partials, only imported by the others, and left out
+	partials bool
+}
+
+// Preprocessors maps source file extensions to their preprocessor, --markdown-ext and then
+// --preprocess add to them.
+var Preprocessors = map[string]preprocessor{
+	".scss": {".css", sassTransform, sassSourceMap, true},
+}
+
+// markdownParser is replaced by useHighlightStyle for --highlight-style.
+var markdownParser = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()),
+)
+
+// markdown renders GitHub flavored markdown, raw html included.
+func markdown(path string, data []byte) ([]byte, error) {
+	out := bytes.Buffer{}
+	if err := markdownParser.Convert(data, &out); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return out.Bytes(), nil
+}
+
+// commandTransform returns a transform that runs command with sh, with the source on stdin and
+// {{input}} replaced by its path, taking stdout as the output.
+func commandTransform(command string) func(string, []byte) ([]byte, error) {
+	return func(path string, data []byte) ([]byte, error) {
+		cmd := exec.Command("sh", "-c", strings.ReplaceAll(command, "{{input}}", shellQuote(path)))
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.Output()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%s: %s: %v: %s", path, command, err, bytes.TrimSpace(exitErr.Stderr))
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, command, err)
+		}
+		return out, nil
+	}
+}
+
+// lookSass returns an error saying what to do if sass isn't installed, for the scss file at path.
+func lookSass(path string) error {
+	if _, err := exec.LookPath("sass"); err != nil {
+		return fmt.Errorf("%s: building .scss files needs sass, install sass or use --preprocess .scss=command to build them another way", path)
+	}
+	return nil
+}
+
+// sassTransform compiles the scss file at path with sass.
+func sassTransform(path string, data []byte) ([]byte, error) {
+	if err := lookSass(path); err != nil {
+		return nil, err
+	}
+	return commandTransform("sass --no-source-map {{input}}")(path, data)
+}
+
+// sassSourceMap compiles the scss file at path with sass, returning the css and its source map.
+// The map embeds the sources, so it works wherever it's served from without them.
+func sassSourceMap(path string, data []byte) ([]byte, []byte, error) {
+	if err := lookSass(path); err != nil {
+		return nil, nil, err
+	}
+	dir, err := ioutil.TempDir("", "sass")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	// Named like the real output, which the sourceMappingURL comment sass adds refers to
+	output := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))+".css")
+	command := "sass --embed-sources " + shellQuote(path) + " " + shellQuote(output)
+	if out, err := exec.Command("sh", "-c", command).CombinedOutput(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s: %v: %s", path, command, err, bytes.TrimSpace(out))
+	}
+	css, err := ioutil.ReadFile(output)
+	if err != nil {
+		return nil, nil, err
+	}
+	sourceMap, err := ioutil.ReadFile(output + ".map")
+	if err != nil {
+		return nil, nil, err
+	}
+	return css, sourceMap, nil
+}
+
+// addMarkdownExts makes files with each of the string separated extensions exts markdown pages,
+// e.g. post.md builds post.html.
+func addMarkdownExts(exts string) error {
+	for _, ext := range strings.Fields(exts) {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("--markdown-ext %s doesn't start with .", ext)
+		}
+		Preprocessors[ext] = preprocessor{".html", markdown, nil, false}
+	}
+	return nil
+}
+
+// addPreprocessors adds the --preprocess commands, each .ext=command or .ext:.outext=command
+// where the output extension defaults to the source's.
+func addPreprocessors(specs []string) error {
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i < 0 || !strings.HasPrefix(spec, ".") {
+			return fmt.Errorf("--preprocess %s is not .ext=command or .ext:.outext=command", spec)
+		}
+		ext, command := spec[:i], spec[i+1:]
+		outExt := ext
+		if j := strings.Index(ext, ":"); j >= 0 {
+			ext, outExt = ext[:j], ext[j+1:]
+		}
+		if ext == "" || !strings.HasPrefix(outExt, ".") {
+			return fmt.Errorf("--preprocess %s is not .ext=command or .ext:.outext=command", spec)
+		}
+		Preprocessors[ext] = preprocessor{outExt, commandTransform(command), nil, false}
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newServer returns the preview server for --addr. net/http negotiates HTTP/2 by itself whenever
+// it serves TLS, so there's nothing to enable for that here.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              *addrFlag,
+		Handler:           handler,
+		ReadHeaderTimeout: *readTimeoutFlag,
+		ReadTimeout:       *readTimeoutFlag,
+		WriteTimeout:      *writeTimeoutFlag,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// accessLogHandler logs each request to handler with its response status, size, and duration.
+func accessLogHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(rec, r)
+		accessLogger.Printf("%s %s %d %dB %s", r.Method, r.URL.RequestURI(), rec.status, rec.bytes, time.Since(start))
+	})
+}
+
+// cspHandler sends --csp as the Content-Security-Policy (or with --csp-report-only,
+// Content-Security-Policy-Report-Only) header of each html response from handler.
+func cspHandler(handler http.Handler) http.Handler {
+	header := "Content-Security-Policy"
+	if *cspReportOnlyFlag {
+		header += "-Report-Only"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&cspWriter{ResponseWriter: w, header: header}, r)
+	})
+}
+
+// cspWriter is a ResponseWriter that adds the header before writing the status of an html response.
+type cspWriter struct {
+	http.ResponseWriter
+	header      string
+	wroteHeader bool
+}
+
+func (w *cspWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			w.Header().Set(w.header, *cspFlag)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cspWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cspWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *cspWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// injectHandler inserts inject before the </body> of each full html response from handler (a page,
+// or a 404 page so it can reload once fixed), or at the end if there's no </body>.
+func injectHandler(handler http.Handler, inject []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		iw := &injectWriter{ResponseWriter: w}
+		handler.ServeHTTP(iw, r)
+		if iw.body == nil {
+			return
+		}
+		body := iw.body.Bytes()
+		i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+		if i < 0 {
+			i = len(body)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)+len(inject)))
+		w.WriteHeader(iw.status)
+		w.Write(body[:i])
+		w.Write(inject)
+		w.Write(body[i:])
+	})
+}
+
+// injectWriter is a ResponseWriter that holds back the body of a full html response for
+// injectHandler, passing anything else through.
+type injectWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        *bytes.Buffer
+}
+
+func (w *injectWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if (status == http.StatusOK || status == http.StatusNotFound) && strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		w.status, w.body = status, &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *injectWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.body != nil {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *injectWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.body == nil {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *injectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// liveReloadPath is where the server at --addr sends --live-reload events.
+const liveReloadPath = "/.static-site/live-reload"
+
+// liveReloadScript, served at liveReloadPath.js, reloads the page on each event from liveReloadPath.
+// It's a file rather than inline so a --csp allowing scripts from 'self' allows it.
+const liveReloadScript = `new EventSource("` + liveReloadPath + `").onmessage = function() { location.reload() }
+`
+
+// liveReloadTag is injected into html responses for --live-reload.
+var liveReloadTag = []byte(`<script src="` + liveReloadPath + `.js"></script>`)
+
+// liveReloads tells the pages open in browsers to reload, see --live-reload.
+var liveReloads = &reloadBroadcaster{clients: map[chan struct{}]bool{}, done: make(chan struct{})}
+
+// reloadBroadcaster streams a server-sent event to each of its clients whenever reload is called.
+type reloadBroadcaster struct {
+	mu        sync.Mutex
+	clients   map[chan struct{}]bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// reload sends an event to every client.
+func (b *reloadBroadcaster) reload() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		select {
+		case c <- struct{}{}:
+		default:
+			// Already has one waiting
+		}
+	}
+}
+
+// close ends every client's stream, so shutting down the server doesn't wait on them.
+func (b *reloadBroadcaster) close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+}
+
+func (b *reloadBroadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.clients[c] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+	}()
+	rc := http.NewResponseController(w)
+	// The stream is open for as long as the page, past --write-timeout
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-b.done:
+			return
+		case <-c:
+			if _, err := io.WriteString(w, "data: reload\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// liveReloadHandler serves liveReloadPath from liveReloads and the liveReloadScript, and everything
+// else from handler with the liveReloadTag injected into html.
+func liveReloadHandler(handler http.Handler) http.Handler {
+	handler = injectHandler(handler, liveReloadTag)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case liveReloadPath:
+			liveReloads.ServeHTTP(w, r)
+			return
+		case liveReloadPath + ".js":
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			io.WriteString(w, liveReloadScript)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// responseRecorder is a ResponseWriter that records the status and bytes written through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// fileHandler serves dir like http.FileServer, except Last-Modified and ETag are keyed to each
+// file's content so a rebuild that rewrites a file unchanged doesn't invalidate browser caches.
+func fileHandler(dir string) http.Handler {
+	fileServer := http.FileServer(http.Dir(dir))
+	modTimes := &contentModTimes{files: map[string]contentModTime{}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Leave redirects and dir listings to the file server
+		if strings.HasSuffix(r.URL.Path, "/index.html") {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+		name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = filepath.Join(name, "index.html")
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+		hash, lastModified, err := modTimes.get(name, info, f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"`+hash+`"`)
+		http.ServeContent(w, r, info.Name(), lastModified, f)
+	})
+}
+
+// notFoundHandler serves the 404.html page in dir, with a 404 status, in place of each 404 response
+// from handler, leaving the response as is if there's no such page.
+func notFoundHandler(handler http.Handler, dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nw := &notFoundWriter{ResponseWriter: w}
+		handler.ServeHTTP(nw, r)
+		if nw.body == nil {
+			return
+		}
+		page, err := ioutil.ReadFile(filepath.Join(dir, "404.html"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(nw.body.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			w.Write(page)
+		}
+	})
+}
+
+// notFoundWriter is a ResponseWriter that holds back a 404 response for notFoundHandler, passing
+// anything else through.
+type notFoundWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	body        *bytes.Buffer
+}
+
+func (w *notFoundWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusNotFound {
+		w.body = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *notFoundWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.body != nil {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *notFoundWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.body == nil {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *notFoundWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// contentModTimes remembers the content hash of each served file, and the time that content was
+// first seen.
+type contentModTimes struct {
+	mu    sync.Mutex
+	files map[string]contentModTime
+}
+
+type contentModTime struct {
+	size         int64
+	modTime      time.Time
+	hash         string
+	lastModified time.Time
+}
+
+// get returns the content hash and Last-Modified time for the file at name, only rehashing f when
+// its size or mtime differ from the last request. f is left at the start.
+func (c *contentModTimes) get(name string, info os.FileInfo, f io.ReadSeeker) (string, time.Time, error) {
+	c.mu.Lock()
+	prev, ok := c.files[name]
+	c.mu.Unlock()
+	if ok && prev.size == info.Size() && prev.modTime.Equal(info.ModTime()) {
+		return prev.hash, prev.lastModified, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", time.Time{}, err
+	}
+	cur := contentModTime{
+		size:         info.Size(),
+		modTime:      info.ModTime(),
+		hash:         fmt.Sprintf("%x", h.Sum(nil))[:16],
+		lastModified: info.ModTime(),
+	}
+	if ok && prev.hash == cur.hash {
+		cur.lastModified = prev.lastModified
+	}
+	c.mu.Lock()
+	c.files[name] = cur
+	c.mu.Unlock()
+	return cur.hash, cur.lastModified, nil
+}
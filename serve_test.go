@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLiveReloadHandler(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"index.html": "<html><body>home</body></html>", "404.html": "<html><body>missing</body></html>", "style.css": "body {}"})
+	setTestFlag(t, "csp", "script-src 'self'")
+	server := httptest.NewServer(cspHandler(liveReloadHandler(notFoundHandler(fileHandler(dir), dir))))
+	defer server.Close()
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+	tests := []struct {
+		path, want string
+		status     int
+	}{
+		{"/", "<html><body>home" + string(liveReloadTag) + "</body></html>", http.StatusOK},
+		{"/nope.html", "<html><body>missing" + string(liveReloadTag) + "</body></html>", http.StatusNotFound},
+		{"/style.css", "body {}", http.StatusOK},
+		{liveReloadPath + ".js", liveReloadScript, http.StatusOK},
+	}
+	for _, test := range tests {
+		resp, body := get(test.path)
+		if resp.StatusCode != test.status || body != test.want {
+			t.Errorf("GET %s = %d %q, want %d %q", test.path, resp.StatusCode, body, test.status, test.want)
+		}
+	}
+}
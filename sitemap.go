@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// baseURL is --base-url without its trailing slash.
+var baseURL string
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// parseBaseURL checks --base-url is an absolute http(s) URL, returning it without a trailing slash.
+func parseBaseURL(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("--base-url must be an absolute http or https URL, not %s", v)
+	}
+	return strings.TrimSuffix(v, "/"), nil
+}
+
+// writeSitemap writes sitemap.xml in the output dir listing pages, leaving out drafts, the root
+// 404.html, and any that aren't html, and the generated pages at the output-relative paths (with
+// their language), prefixed by --base-url.
+func writeSitemap(pages []*PageInfo, generated map[string]string) error {
+	outPath := filepath.Join(*outFlag, "sitemap.xml")
+	if outputWritten(outPath) {
+		verboseLogger.Printf("Not writing sitemap, the input dir has one: %s", outPath)
+		return nil
+	}
+	urlSet := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, page := range pages {
+		if page.Page["draft"] == true || !(isHTML(page.URL) || strings.HasSuffix(page.URL, "/")) || page.URL == "/404.html" {
+			continue
+		}
+		entry := sitemapURL{Loc: baseURL + langURL(page.Lang, page.URL)}
+		if !page.Date.IsZero() {
+			entry.LastMod = page.Date.Format(time.RFC3339)
+		}
+		urlSet.URLs = append(urlSet.URLs, entry)
+	}
+	for outRelPath := range generated {
+		u := "/" + filepath.ToSlash(outRelPath)
+		if (*indexDirURLsFlag || *prettyURLsFlag) && strings.HasSuffix(u, "/index.html") {
+			u = strings.TrimSuffix(u, "index.html")
+		}
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{Loc: baseURL + u})
+	}
+	// Sorted so builds are reproducible
+	sort.Slice(urlSet.URLs, func(i, j int) bool {
+		return urlSet.URLs[i].Loc < urlSet.URLs[j].Loc
+	})
+	b, err := xml.MarshalIndent(urlSet, "", "  ")
+	if err != nil {
+		return err
+	}
+	verboseLogger.Printf("Writing sitemap: %s", outPath)
+	return writeOutputFile(outPath, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// buildState is what --state keeps between builds to only rebuild the outputs of changed inputs.
+type buildState struct {
+	// Hash of everything any page could depend on, if it changes everything is rebuilt
+	Global string `json:"global"`
+	// Paths of the inputs built last time
+	Files map[string]stateFile `json:"files"`
+}
+
+type stateFile struct {
+	Hash    string `json:"hash"`    // Of the input's content
+	OutPath string `json:"outPath"` // Where it was built to
+}
+
+// readState reads the --state file, an empty state if there isn't one yet.
+func readState() (*buildState, error) {
+	state := &buildState{Files: map[string]stateFile{}}
+	data, err := ioutil.ReadFile(*stateFlag)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, &IOError{*stateFlag, err}
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, &DataError{*stateFlag, fmt.Errorf("%s: %v", *stateFlag, err)}
+	}
+	return state, nil
+}
+
+// write writes the state to the --state file.
+func (s *buildState) write() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	verboseLogger.Printf("Writing state: %s", *stateFlag)
+	if err := ioutil.WriteFile(*stateFlag, data, 0644); err != nil {
+		return &IOError{*stateFlag, err}
+	}
+	return nil
+}
+
+// globalHash hashes what any page could depend on besides its own file: the command line, the
+// pinned build time, the templates, the data, --icons, and --i18n dirs, the redirects (aliases
+// included), the front matter of every page (for .Pages and taxonomies), the --globals, and the
+// assets (for the asset func, which --fingerprint-ext names change). pageHashes is added for
+// outputs drawn from every page's content, like --search-index.
+func globalHash(templateFiles []string, templateContents [][]byte, pages []*PageInfo, redirects map[string]string, globals interface{}, assets, pageHashes map[string]string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", os.Args[1:])
+	fmt.Fprintf(h, "time %s\n", pinnedTime.Format(time.RFC3339))
+	for i, path := range templateFiles {
+		fmt.Fprintf(h, "template %s %x\n", path, sha256.Sum256(templateContents[i]))
+	}
+	for _, dir := range []string{*dataFlag, *iconsFlag, *i18nFlag} {
+		if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			if err != nil || info.IsDir() {
+				return err
+			}
+			hash, err := hashFile(path)
+			fmt.Fprintf(h, "data %s %s\n", path, hash)
+			return err
+		}); err != nil {
+			return "", &IOError{dir, err}
+		}
+	}
+	enc := json.NewEncoder(h)
+	for _, v := range []interface{}{pages, redirects, globals, assets, pageHashes} {
+		if err := enc.Encode(v); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashFile returns the hex sha256 of the file's content.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Term is a value of one of the --taxonomies front matter keys, e.g. a tag, with the pages that
+// have it.
+type Term struct {
+	Taxonomy string      // The front matter key, e.g. tags
+	Name     string      // As first seen in the front matter
+	URL      string      // Absolute, ready for .URL and .Active, e.g. /tags/go/index.html
+	Pages    []*PageInfo // Sorted by path
+}
+
+// collectTerms returns the terms of each taxonomy sorted by URL, leaving out drafts. Terms that
+// slugify the same, like "Go" and "go", are one term.
+func collectTerms(taxonomies []string, pages []*PageInfo) map[string][]*Term {
+	all := map[string][]*Term{}
+	for _, taxonomy := range taxonomies {
+		terms := map[string]*Term{}
+		for _, page := range pages {
+			if page.Page["draft"] == true {
+				continue
+			}
+			for _, name := range termNames(page.Page[taxonomy]) {
+				slug := slugify(name)
+				term, ok := terms[slug]
+				if !ok {
+					term = &Term{Taxonomy: taxonomy, Name: name, URL: "/" + taxonomy + "/" + slug + "/index.html"}
+					terms[slug] = term
+				}
+				if n := len(term.Pages); n == 0 || term.Pages[n-1] != page {
+					term.Pages = append(term.Pages, page)
+				}
+			}
+		}
+		list := []*Term{}
+		for _, term := range terms {
+			list = append(list, term)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].URL < list[j].URL
+		})
+		all[taxonomy] = list
+	}
+	return all
+}
+
+// termNames returns the terms in a front matter value, a string or a list of them.
+func termNames(v interface{}) []string {
+	names := []string{}
+	for _, name := range stringList(v) {
+		if slugify(name) != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// renderGenerated writes the page at the output-relative outRelPath, under data.Lang, from the
+// template name, placed as .Content of its layout, or on its own if the layout doesn't use .Content.
+// Its --banner names source as what it was generated from.
+func renderGenerated(tmpl *template.Template, layoutUsesContent bool, outRelPath, name, source string, data *TemplateData) error {
+	t, err := tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	withPageFuncs(t, outRelPath, outRelPath, data.Lang)
+	if t.Lookup(name) == nil {
+		return fmt.Errorf("no template %s for %s", name, outRelPath)
+	}
+	verboseLogger.Printf("Executing template %s: %s", name, outRelPath)
+	executeStart := time.Now()
+	rendered := bytes.Buffer{}
+	err = t.ExecuteTemplate(&rendered, name, data)
+	templateProfile.record(name, time.Since(executeStart))
+	if err != nil {
+		return &ExecuteError{outRelPath, err}
+	}
+	if layoutUsesContent {
+		layoutName := sectionLayout(tmpl, outRelPath)
+		if layoutName == "" {
+			layoutName = tmpl.Name()
+		}
+		data.Content = template.HTML(rendered.String())
+		rendered.Reset()
+		executeStart := time.Now()
+		err := t.ExecuteTemplate(&rendered, layoutName, data)
+		templateProfile.record(layoutName, time.Since(executeStart))
+		if err != nil {
+			return &ExecuteError{outRelPath, err}
+		}
+	}
+	out := rendered.Bytes()
+	if *minifyFlag {
+		out = minifyHTML(out)
+	}
+	outPath := filepath.Join(*outFlag, data.Lang, outRelPath)
+	if err := Output.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return &IOError{outPath, err}
+	}
+	if err := writeOutputFile(outPath, insertBanner(banner(source, outPath, buildTime), out), 0644); err != nil {
+		return &IOError{outPath, err}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"unicode"
+)
+
+// asciiFolds are the ASCII spellings slugify uses for lowercase accented and other latin letters.
+var asciiFolds = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ľ': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// slugify lowercases s, spells accented latin letters in ASCII (see asciiFolds), and replaces each
+// run of anything but letters and digits with a dash, e.g. "Crème Brûlée!" is "creme-brulee".
+func slugify(s string) string {
+	b := strings.Builder{}
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			if fold, ok := asciiFolds[r]; ok {
+				b.WriteString(fold)
+			} else {
+				b.WriteRune(r)
+			}
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// truncate returns v as text cut to at most n runes, ellipsis included, at the last space that
+// fits, e.g. {{truncate 160 .Content}}. html (like .Content) has its tags left out and its entities
+// unescaped first, and whitespace is collapsed either way.
+func truncate(n int, v interface{}) (string, error) {
+	if n < 1 {
+		return "", fmt.Errorf("truncate needs at least 1 rune, not %d", n)
+	}
+	s := strings.Join(strings.Fields(fmt.Sprint(v)), " ")
+	if h, ok := v.(template.HTML); ok {
+		s = plainText(string(h))
+	}
+	runes := []rune(s)
+	if len(runes) <= n {
+		return string(runes), nil
+	}
+	cut := runes[:n-1]
+	for i := len(cut) - 1; i > 0; i-- {
+		if cut[i] == ' ' {
+			cut = cut[:i]
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(cut), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) + "…", nil
+}
+
+// titleCase returns s with the first letter of each word uppercased, leaving the rest as is.
+func titleCase(s string) string {
+	b := strings.Builder{}
+	start := true
+	for _, r := range s {
+		if start && unicode.IsLetter(r) {
+			r = unicode.ToTitle(r)
+		}
+		start = !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '’')
+		b.WriteRune(r)
+	}
+	return b.String()
+}
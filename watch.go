@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watch calls onChange with the paths created, written, removed, or renamed under paths, once the
+// changes have been quiet for debounce. Dirs are watched recursively, new ones included, and
+// files through their dir so editors replacing them on save are still seen. Paths that don't
+// exist are skipped with an error logged. It returns once ctx is done, or if watching fails. A
+// pollInterval over 0 scans paths that often instead, see pollWatch.
+func watch(ctx context.Context, paths []string, debounce, pollInterval time.Duration, onChange func(changed []string)) error {
+	if pollInterval > 0 {
+		return pollWatch(ctx, paths, debounce, pollInterval, onChange)
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	roots := []string{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		info, err := os.Stat(path)
+		if err != nil {
+			errLogger.Printf("Not watching %s: %v", path, err)
+			continue
+		}
+		if info.IsDir() {
+			err = watchDir(w, path)
+		} else {
+			err = w.Add(filepath.Dir(path))
+		}
+		if err != nil {
+			return err
+		}
+		roots = append(roots, path)
+	}
+
+	changed := map[string]bool{}
+	var quiet <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			// The dir of a watched file has others in it
+			if event.Op == fsnotify.Chmod || !withinAny(roots, event.Name) {
+				continue
+			}
+			verboseLogger.Printf("Change detected in %s", event.Name)
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchDir(w, event.Name); err != nil {
+						errLogger.Print(err)
+					}
+				}
+			}
+			changed[event.Name] = true
+			quiet = time.After(debounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			errLogger.Print(err)
+		case <-quiet:
+			paths := []string{}
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			changed, quiet = map[string]bool{}, nil
+			onChange(paths)
+		}
+	}
+}
+
+// pollWatch is watch for filesystems that don't deliver events (e.g. some network and container
+// mounts), scanning the files under paths every interval for ones created, removed, or changed in
+// size or modification time since the last scan.
+func pollWatch(ctx context.Context, paths []string, debounce, interval time.Duration, onChange func(changed []string)) error {
+	roots := []string{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if _, err := os.Stat(path); err != nil {
+			errLogger.Printf("Not watching %s: %v", path, err)
+			continue
+		}
+		roots = append(roots, path)
+	}
+	prev := scanFiles(roots)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	changed := map[string]bool{}
+	var quiet <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			cur := scanFiles(roots)
+			for path, stamp := range cur {
+				if prevStamp, ok := prev[path]; !ok || prevStamp != stamp {
+					changed[path] = true
+					quiet = time.After(debounce)
+					verboseLogger.Printf("Change detected in %s", path)
+				}
+			}
+			for path := range prev {
+				if _, ok := cur[path]; !ok {
+					changed[path] = true
+					quiet = time.After(debounce)
+					verboseLogger.Printf("Change detected in %s", path)
+				}
+			}
+			prev = cur
+		case <-quiet:
+			paths := []string{}
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			changed, quiet = map[string]bool{}, nil
+			onChange(paths)
+		}
+	}
+}
+
+// fileStamp is what pollWatch compares to tell a file changed.
+type fileStamp struct {
+	size    int64
+	modTime int64
+}
+
+// scanFiles returns the stamp of each file under roots, skipping any that can't be read, like
+// ones removed mid-scan.
+func scanFiles(roots []string) map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				stamps[path] = fileStamp{info.Size(), info.ModTime().UnixNano()}
+			}
+			return nil
+		})
+	}
+	return stamps
+}
+
+// watchDir adds dir and every dir under it to w.
+func watchDir(w *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return w.Add(path)
+		}
+		return nil
+	})
+}
+
+// withinAny reports whether path is one of the dirs or files in paths or lies beneath one of them.
+func withinAny(paths []string, path string) bool {
+	for _, p := range paths {
+		if withinDir(p, path) {
+			return true
+		}
+	}
+	return false
+}